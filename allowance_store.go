@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var allowancePrefix = []byte("allowance-")
+
+// 授权数量大于等于2^255视为无限授权, 无限授权被使用后也仍然远大于这个值
+var unlimitedAllowance = new(big.Int).Lsh(big.NewInt(1), 255)
+
+// Allowance is the current allowance of a spender over the tokens of an
+// owner, as set by the last Approval event or read from the state after the
+// owner's tokens were last moved.
+type Allowance struct {
+	Token       string  `json:"token"`
+	Owner       string  `json:"owner"`
+	Spender     string  `json:"spender"`
+	Value       big.Int `json:"value"`
+	Unlimited   bool    `json:"unlimited"`
+	BlockNumber uint64  `json:"block_number"`
+	Hash        string  `json:"hash"` // 最后一次授权或者使用授权的交易
+}
+
+type allowanceUpdate struct {
+	Value       big.Int `json:"value"`
+	BlockNumber uint64  `json:"block_number"`
+	BlockHash   string  `json:"block_hash"`
+	LogIndex    uint64  `json:"log_index"`
+	Hash        string  `json:"hash"`
+}
+
+// allowanceEntry keeps the updates still inside the reorg window plus the
+// last one before it, so that a retracted update falls back to the value
+// before it.
+type allowanceEntry struct {
+	Token      string            `json:"token"`
+	Owner      string            `json:"owner"`
+	Spender    string            `json:"spender"`
+	UpdateList []allowanceUpdate `json:"update_list"` // 按区块号和日志序号排序
+}
+
+// AllowanceReader reads allowance(owner, spender) of a token at the state
+// after a block, false if the state is not available or the call failed.
+type AllowanceReader func(token common.Address, owner common.Address, spender common.Address, blockHash common.Hash) (*big.Int, bool)
+
+// AllowanceStore maintains the allowance per (token, owner, spender) from the
+// exported Approval events. transferFrom spends an allowance without an
+// Approval event, so when the tokens of an owner move, the allowances known
+// for the owner are read again from the state after the block. Updates are
+// ordered by block and log index, so blocks may be applied out of order, for
+// example by a migration.
+type AllowanceStore struct {
+	db     ethdb.Database
+	depth  uint64
+	reader AllowanceReader
+	lock   sync.Mutex
+}
+
+// NewAllowanceStore creates a store, reader may be nil and then only the
+// Approval events change the allowances.
+func NewAllowanceStore(db ethdb.Database, depth uint64, reader AllowanceReader) *AllowanceStore {
+	return &AllowanceStore{
+		db:     db,
+		depth:  depth,
+		reader: reader,
+	}
+}
+
+func normalizeAddress(address string) string {
+	return common.HexToAddress(address).String()
+}
+
+// 按owner排在前面, 方便查询一个地址的全部授权
+func allowanceKey(owner string, token string, spender string) []byte {
+	return []byte(fmt.Sprintf("%s%s-%s-%s", allowancePrefix, owner, token, spender))
+}
+
+func isApprovalEvent(transaction *Transaction) bool {
+	return transaction.TokenType == TokenTypeApproval && transaction.LogIndex.Sign() >= 0 && !transaction.Removed
+}
+
+// isSpendingTransfer tells whether a record is an ERC-20 Transfer event that
+// moved the tokens of an owner, which may have spent an allowance.
+func isSpendingTransfer(transaction *Transaction) bool {
+	return transaction.TokenType == TokenTypeToken && transaction.LogIndex.Sign() >= 0 && !transaction.Removed &&
+		normalizeAddress(transaction.From) != zeroAddress
+}
+
+func allowancePrefixOf(owner string, token string) []byte {
+	return []byte(fmt.Sprintf("%s%s-%s-", allowancePrefix, owner, token))
+}
+
+// entries returns the allowances of an owner over a token, keyed by their
+// database key.
+func (s *AllowanceStore) entries(owner string, token string) map[string]*allowanceEntry {
+	entries := map[string]*allowanceEntry{}
+	it := s.db.NewIterator(allowancePrefixOf(owner, token), nil)
+	defer it.Release()
+	for it.Next() {
+		entry := &allowanceEntry{}
+		if err := json.Unmarshal(it.Value(), entry); err != nil {
+			log.Errorf("unmarshal allowance %v error %v", string(it.Key()), err)
+			continue
+		}
+		entries[string(it.Key())] = entry
+	}
+	return entries
+}
+
+func (s *AllowanceStore) get(key []byte) (*allowanceEntry, error) {
+	data, err := s.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	entry := &allowanceEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *AllowanceStore) put(key []byte, entry *allowanceEntry) error {
+	if len(entry.UpdateList) == 0 {
+		return s.db.Delete(key)
+	}
+	marshal, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(key, marshal)
+}
+
+// Apply records the Approval events among the records of a block, and reads
+// again the allowances of the owners whose tokens moved.
+func (s *AllowanceStore) Apply(transactionList []Transaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		if !isApprovalEvent(transaction) {
+			continue
+		}
+		token, owner, spender := normalizeAddress(transaction.ContractAddress), normalizeAddress(transaction.From), normalizeAddress(transaction.Spender)
+		key := allowanceKey(owner, token, spender)
+		entry, err := s.get(key)
+		if err != nil {
+			entry = &allowanceEntry{Token: token, Owner: owner, Spender: spender}
+		}
+		update := allowanceUpdate{
+			Value:       transaction.TokenValue,
+			BlockNumber: transaction.BlockNumber.Uint64(),
+			BlockHash:   transaction.BlockHash,
+			LogIndex:    transaction.LogIndex.Uint64(),
+			Hash:        transaction.Hash,
+		}
+		entry.insert(update, s.depth)
+		if err := s.put(key, entry); err != nil {
+			log.Errorf("put allowance %v error %v", string(key), err)
+		}
+	}
+	s.applyTransfers(transactionList)
+}
+
+// applyTransfers reads the allowances of the owners whose tokens moved from
+// the state after the block, the value is ordered at the last Transfer event
+// of the owner in the block.
+func (s *AllowanceStore) applyTransfers(transactionList []Transaction) {
+	if s.reader == nil {
+		return
+	}
+	type transferKey struct {
+		owner     string
+		token     string
+		blockHash string
+	}
+	var keyList []transferKey
+	transfers := map[transferKey]*Transaction{}
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		if !isSpendingTransfer(transaction) {
+			continue
+		}
+		key := transferKey{normalizeAddress(transaction.From), normalizeAddress(transaction.ContractAddress), transaction.BlockHash}
+		last, ok := transfers[key]
+		if !ok {
+			keyList = append(keyList, key)
+		}
+		if !ok || transaction.LogIndex.Cmp(&last.LogIndex) > 0 {
+			transfers[key] = transaction
+		}
+	}
+	for _, key := range keyList {
+		transaction := transfers[key]
+		for entryKey, entry := range s.entries(key.owner, key.token) {
+			if len(entry.UpdateList) == 0 || entry.allowance().Value.Sign() == 0 {
+				//没有授权, 不会被使用
+				continue
+			}
+			value, ok := s.reader(common.HexToAddress(entry.Token), common.HexToAddress(entry.Owner), common.HexToAddress(entry.Spender), common.HexToHash(transaction.BlockHash))
+			if !ok || value.Cmp(&entry.allowance().Value) == 0 {
+				continue
+			}
+			entry.insert(allowanceUpdate{
+				Value:       *value,
+				BlockNumber: transaction.BlockNumber.Uint64(),
+				BlockHash:   transaction.BlockHash,
+				LogIndex:    transaction.LogIndex.Uint64(),
+				Hash:        transaction.Hash,
+			}, s.depth)
+			if err := s.put([]byte(entryKey), entry); err != nil {
+				log.Errorf("put allowance %v error %v", entryKey, err)
+			}
+		}
+	}
+}
+
+func (e *allowanceEntry) insert(update allowanceUpdate, depth uint64) {
+	for _, u := range e.UpdateList {
+		if u.BlockHash == update.BlockHash && u.LogIndex == update.LogIndex {
+			//同一个区块重复导出
+			return
+		}
+	}
+	e.UpdateList = append(e.UpdateList, update)
+	sort.SliceStable(e.UpdateList, func(i, j int) bool {
+		a, b := e.UpdateList[i], e.UpdateList[j]
+		if a.BlockNumber != b.BlockNumber {
+			return a.BlockNumber < b.BlockNumber
+		}
+		return a.LogIndex < b.LogIndex
+	})
+	//只保留reorg窗口内的更新和窗口前的最后一次
+	last := e.UpdateList[len(e.UpdateList)-1].BlockNumber
+	keep := 0
+	for keep < len(e.UpdateList)-1 && e.UpdateList[keep+1].BlockNumber+depth <= last {
+		keep++
+	}
+	e.UpdateList = e.UpdateList[keep:]
+}
+
+// Retract drops the updates a block that was reorged out made by its Approval
+// events and Transfer events, the allowances fall back to their value before
+// the block.
+func (s *AllowanceStore) Retract(transactionList []Transaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		switch {
+		case isApprovalEvent(transaction):
+			key := allowanceKey(normalizeAddress(transaction.From), normalizeAddress(transaction.ContractAddress), normalizeAddress(transaction.Spender))
+			if entry, err := s.get(key); err == nil {
+				s.retractBlock(key, entry, transaction.BlockHash)
+			}
+		case isSpendingTransfer(transaction):
+			for key, entry := range s.entries(normalizeAddress(transaction.From), normalizeAddress(transaction.ContractAddress)) {
+				s.retractBlock([]byte(key), entry, transaction.BlockHash)
+			}
+		}
+	}
+}
+
+func (s *AllowanceStore) retractBlock(key []byte, entry *allowanceEntry, blockHash string) {
+	var updateList []allowanceUpdate
+	for _, update := range entry.UpdateList {
+		if update.BlockHash != blockHash {
+			updateList = append(updateList, update)
+		}
+	}
+	if len(updateList) == len(entry.UpdateList) {
+		return
+	}
+	entry.UpdateList = updateList
+	if err := s.put(key, entry); err != nil {
+		log.Errorf("put allowance %v error %v", string(key), err)
+	}
+}
+
+func (e *allowanceEntry) allowance() *Allowance {
+	update := e.UpdateList[len(e.UpdateList)-1]
+	return &Allowance{
+		Token:       e.Token,
+		Owner:       e.Owner,
+		Spender:     e.Spender,
+		Value:       update.Value,
+		Unlimited:   update.Value.Cmp(unlimitedAllowance) >= 0,
+		BlockNumber: update.BlockNumber,
+		Hash:        update.Hash,
+	}
+}
+
+// List returns the non-zero allowances given by an owner, of one token or of
+// all tokens when token is empty.
+func (s *AllowanceStore) List(owner string, token string) []*Allowance {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefix := fmt.Sprintf("%s%s-", allowancePrefix, normalizeAddress(owner))
+	if token != "" {
+		prefix = fmt.Sprintf("%s%s-", prefix, normalizeAddress(token))
+	}
+	allowanceList := []*Allowance{}
+	it := s.db.NewIterator([]byte(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		entry := &allowanceEntry{}
+		if err := json.Unmarshal(it.Value(), entry); err != nil {
+			log.Errorf("unmarshal allowance %v error %v", string(it.Key()), err)
+			continue
+		}
+		if len(entry.UpdateList) == 0 {
+			continue
+		}
+		if allowance := entry.allowance(); allowance.Value.Sign() > 0 {
+			allowanceList = append(allowanceList, allowance)
+		}
+	}
+	return allowanceList
+}
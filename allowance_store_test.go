@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func approvalEvent(block int64, blockHash string, value *big.Int) Transaction {
+	return Transaction{
+		BlockNumber:     *big.NewInt(block),
+		BlockHash:       blockHash,
+		LogIndex:        *big.NewInt(0),
+		TokenType:       TokenTypeApproval,
+		ContractAddress: "0x000000000000000000000000000000000000000c",
+		From:            "0x000000000000000000000000000000000000000a",
+		Spender:         "0x000000000000000000000000000000000000000b",
+		TokenValue:      *value,
+	}
+}
+
+func TestAllowanceStore(t *testing.T) {
+	store := NewAllowanceStore(rawdb.NewMemoryDatabase(), 10, nil)
+	owner := common.HexToAddress("0x0a").String()
+	unlimited := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+	store.Apply([]Transaction{approvalEvent(100, "0x100", big.NewInt(5))})
+	store.Apply([]Transaction{approvalEvent(105, "0x105", unlimited)})
+	//迁移补写更早的区块不覆盖
+	store.Apply([]Transaction{approvalEvent(90, "0x90", big.NewInt(1))})
+	allowanceList := store.List(owner, "")
+	if len(allowanceList) != 1 || !allowanceList[0].Unlimited || allowanceList[0].BlockNumber != 105 {
+		t.Fatalf("got %v", allowanceList)
+	}
+
+	//回滚后恢复到之前的值
+	store.Retract([]Transaction{approvalEvent(105, "0x105", unlimited)})
+	allowanceList = store.List(owner, common.HexToAddress("0x0c").String())
+	if len(allowanceList) != 1 || allowanceList[0].Unlimited || allowanceList[0].Value.Int64() != 5 {
+		t.Fatalf("got %v after retract", allowanceList)
+	}
+
+	//撤销授权
+	store.Apply([]Transaction{approvalEvent(106, "0x106", big.NewInt(0))})
+	if allowanceList := store.List(owner, ""); len(allowanceList) != 0 {
+		t.Fatalf("got %v after revoke", allowanceList)
+	}
+}
+
+func TestAllowanceStoreTransferFrom(t *testing.T) {
+	owner := common.HexToAddress("0x0a")
+	spender := common.HexToAddress("0x0b")
+	token := common.HexToAddress("0x0c")
+	//transferFrom 之后区块状态里的 allowance
+	state := map[common.Hash]*big.Int{common.HexToHash("0x101"): big.NewInt(3)}
+	reader := func(readToken common.Address, readOwner common.Address, readSpender common.Address, blockHash common.Hash) (*big.Int, bool) {
+		if readToken != token || readOwner != owner || readSpender != spender {
+			t.Fatalf("read allowance of %v %v %v", readToken.String(), readOwner.String(), readSpender.String())
+		}
+		value, ok := state[blockHash]
+		return value, ok
+	}
+	store := NewAllowanceStore(rawdb.NewMemoryDatabase(), 10, reader)
+	store.Apply([]Transaction{approvalEvent(100, common.HexToHash("0x100").String(), big.NewInt(5))})
+
+	transfer := Transaction{
+		BlockNumber:     *big.NewInt(101),
+		BlockHash:       common.HexToHash("0x101").String(),
+		LogIndex:        *big.NewInt(3),
+		TokenType:       TokenTypeToken,
+		ContractAddress: token.String(),
+		From:            owner.String(),
+		To:              common.HexToAddress("0x0d").String(),
+		TokenValue:      *big.NewInt(2),
+	}
+	store.Apply([]Transaction{transfer})
+	allowanceList := store.List(owner.String(), "")
+	if len(allowanceList) != 1 || allowanceList[0].Value.Int64() != 3 || allowanceList[0].BlockNumber != 101 {
+		t.Fatalf("got %v after transferFrom", allowanceList)
+	}
+
+	//回滚后恢复到使用之前
+	store.Retract([]Transaction{transfer})
+	if allowanceList := store.List(owner.String(), ""); len(allowanceList) != 1 || allowanceList[0].Value.Int64() != 5 {
+		t.Fatalf("got %v after retract", allowanceList)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// BlockJournal remembers what was exported for the most recent blocks, so the
+// records of a block can be retracted once it is reorged out of the chain.
+type BlockJournal struct {
+	db    ethdb.Database
+	depth uint64
+	lock  sync.Mutex
+}
+
+type journalEntry struct {
+	Hash            string        `json:"hash"`
+	TransactionList []Transaction `json:"transaction_list"`
+}
+
+func NewBlockJournal(db ethdb.Database, depth uint64) *BlockJournal {
+	return &BlockJournal{
+		db:    db,
+		depth: depth,
+	}
+}
+
+var journalPrefix = []byte("journal-")
+
+func journalKey(number uint64) []byte {
+	return []byte(fmt.Sprintf("%s%d", journalPrefix, number))
+}
+
+func (s *BlockJournal) get(number uint64) (*journalEntry, error) {
+	data, err := s.db.Get(journalKey(number))
+	if err != nil {
+		return nil, err
+	}
+	entry := &journalEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Put records the exported transaction list of a block and forgets the blocks
+// that dropped out of the reorg window.
+func (s *BlockJournal) Put(number uint64, hash common.Hash, transactionList []Transaction) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	marshal, err := json.Marshal(journalEntry{
+		Hash:            hash.String(),
+		TransactionList: stripCallTreeList(transactionList),
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.db.Put(journalKey(number), marshal); err != nil {
+		return err
+	}
+	if number > s.depth {
+		s.prune(number - s.depth)
+	}
+	return nil
+}
+
+// prune deletes the journal of every block up to the given height, including
+// the heights that were skipped or written out of order.
+func (s *BlockJournal) prune(number uint64) {
+	//key 没有补零, 不能按范围遍历, 逐个解析区块号
+	var keyList [][]byte
+	it := s.db.NewIterator(journalPrefix, nil)
+	for it.Next() {
+		journalNumber, err := strconv.ParseUint(string(it.Key()[len(journalPrefix):]), 10, 64)
+		if err != nil || journalNumber > number {
+			continue
+		}
+		keyList = append(keyList, common.CopyBytes(it.Key()))
+	}
+	it.Release()
+	for _, key := range keyList {
+		if err := s.db.Delete(key); err != nil {
+			log.Errorf("delete journal %v error %v", string(key), err)
+		}
+	}
+}
+
+// Hash returns the hash of the block exported at the given height, if any.
+func (s *BlockJournal) Hash(number uint64) (common.Hash, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, err := s.get(number)
+	if err != nil {
+		return common.Hash{}, false
+	}
+	return common.HexToHash(entry.Hash), true
+}
+
+// ReplaceTransaction swaps the journaled records of one transaction for new
+// ones, if the block is still journaled with the same hash.
+func (s *BlockJournal) ReplaceTransaction(number uint64, hash common.Hash, txHash string, transactionList []Transaction) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, err := s.get(number)
+	if err != nil || entry.Hash != hash.String() {
+		return false
+	}
+	var newTransactionList []Transaction
+	for _, transaction := range entry.TransactionList {
+		if transaction.Hash != txHash {
+			newTransactionList = append(newTransactionList, transaction)
+		}
+	}
+	newTransactionList = append(newTransactionList, stripCallTreeList(transactionList)...)
+	SortTransactionList(newTransactionList)
+	entry.TransactionList = newTransactionList
+	marshal, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("marshal journal of block %v error %v", number, err)
+		return false
+	}
+	if err := s.db.Put(journalKey(number), marshal); err != nil {
+		log.Errorf("put journal of block %v error %v", number, err)
+		return false
+	}
+	return true
+}
+
+// Remove drops the journal of the given block and returns what was exported
+// for it. Nothing is returned when the journal holds a different block.
+func (s *BlockJournal) Remove(number uint64, hash common.Hash) ([]Transaction, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, err := s.get(number)
+	if err != nil || entry.Hash != hash.String() {
+		return nil, false
+	}
+	if err := s.db.Delete(journalKey(number)); err != nil {
+		log.Errorf("delete journal of block %v error %v", number, err)
+		return nil, false
+	}
+	return entry.TransactionList, true
+}
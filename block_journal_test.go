@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestBlockJournal(t *testing.T) {
+	journal := NewBlockJournal(rawdb.NewMemoryDatabase(), 2)
+	hash1 := common.HexToHash("0x01")
+	hash2 := common.HexToHash("0x02")
+	journal.Put(1, hash1, []Transaction{{Hash: "0xaa"}})
+	journal.Put(2, hash2, []Transaction{{Hash: "0xbb"}, {Hash: "0xcc"}})
+
+	if _, ok := journal.Remove(2, hash1); ok {
+		t.Fatalf("removed block 2 with the hash of block 1")
+	}
+	transactionList, ok := journal.Remove(2, hash2)
+	if !ok || len(transactionList) != 2 {
+		t.Fatalf("remove block 2 got %v %v", transactionList, ok)
+	}
+	if _, ok := journal.Hash(2); ok {
+		t.Fatalf("block 2 still in journal")
+	}
+
+	//超出深度的区块被清理
+	journal.Put(3, hash2, nil)
+	if _, ok := journal.Hash(1); ok {
+		t.Fatalf("block 1 should be pruned")
+	}
+
+	//跳过的和乱序写入的区块也被清理
+	journal.Put(5, hash1, nil)
+	journal.Put(20, hash1, nil)
+	for _, number := range []uint64{3, 5} {
+		if _, ok := journal.Hash(number); ok {
+			t.Fatalf("block %v should be pruned", number)
+		}
+	}
+	if _, ok := journal.Hash(20); !ok {
+		t.Fatalf("block 20 pruned")
+	}
+}
+
+func TestBlockJournalReplaceTransaction(t *testing.T) {
+	journal := NewBlockJournal(rawdb.NewMemoryDatabase(), 2)
+	hash := common.HexToHash("0x01")
+	journal.Put(1, hash, []Transaction{
+		{Hash: "0xaa", InternalIndex: InternalIndexDefault, Status: TransactionStatusTimeout},
+		{Hash: "0xbb", InternalIndex: InternalIndexDefault, TransactionIndex: *big.NewInt(1)},
+	})
+	if journal.ReplaceTransaction(1, common.HexToHash("0x02"), "0xaa", nil) {
+		t.Fatalf("replaced block 1 with another hash")
+	}
+	ok := journal.ReplaceTransaction(1, hash, "0xaa", []Transaction{
+		{Hash: "0xaa", InternalIndex: "0_0"},
+		{Hash: "0xaa", InternalIndex: InternalIndexDefault, CallTree: &CallTreeNode{}},
+	})
+	transactionList, _ := journal.Remove(1, hash)
+	if !ok || len(transactionList) != 3 || transactionList[0].InternalIndex != InternalIndexDefault ||
+		transactionList[0].Status != TransactionStatusSuccess || transactionList[1].InternalIndex != "0_0" || transactionList[2].Hash != "0xbb" ||
+		transactionList[0].CallTree != nil {
+		t.Fatalf("got %v", transactionList)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var doneBlockPrefix = []byte("doneBlock-")
+
+// BlockWatermark tracks the blocks finished by the parallel block workers and
+// only moves the lastBlock checkpoint over a gap-free prefix of them. Blocks
+// finished ahead of the prefix are kept in the database, so that a restart
+// neither skips nor redoes them.
+type BlockWatermark struct {
+	db         ethdb.Database
+	checkpoint func(uint64)
+	lock       sync.Mutex
+	cond       *sync.Cond
+	closed     bool
+	next       uint64          // 最小的未完成区块
+	done       map[uint64]bool // next之后已经完成的区块
+}
+
+func NewBlockWatermark(db ethdb.Database, next uint64, checkpoint func(uint64)) *BlockWatermark {
+	s := &BlockWatermark{
+		db:         db,
+		checkpoint: checkpoint,
+		next:       next,
+		done:       map[uint64]bool{},
+	}
+	s.cond = sync.NewCond(&s.lock)
+	it := db.NewIterator(doneBlockPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		number, err := strconv.ParseUint(string(bytes.TrimPrefix(it.Key(), doneBlockPrefix)), 10, 64)
+		if err != nil {
+			log.Errorf("invalid done block key %v", string(it.Key()))
+			continue
+		}
+		if number < next {
+			db.Delete(doneBlockKey(number))
+			continue
+		}
+		s.done[number] = true
+	}
+	s.advance()
+	return s
+}
+
+func doneBlockKey(number uint64) []byte {
+	return []byte(fmt.Sprintf("%s%d", doneBlockPrefix, number))
+}
+
+// ClearBlockWatermark forgets every block finished ahead of the checkpoint.
+func ClearBlockWatermark(db ethdb.Database) {
+	it := db.NewIterator(doneBlockPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		if err := db.Delete(it.Key()); err != nil {
+			log.Errorf("delete done block key %v error %v", string(it.Key()), err)
+		}
+	}
+}
+
+// Next returns the lowest block that is not finished yet.
+func (s *BlockWatermark) Next() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.next
+}
+
+// DoneAhead reports whether the block was finished ahead of the checkpoint,
+// for example by a worker before the last restart.
+func (s *BlockWatermark) DoneAhead(number uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.done[number]
+}
+
+// Forget drops a block finished ahead of the checkpoint, so that it will be
+// exported again.
+func (s *BlockWatermark) Forget(number uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.done[number] {
+		return
+	}
+	delete(s.done, number)
+	if err := s.db.Delete(doneBlockKey(number)); err != nil {
+		log.Errorf("delete done block %v error %v", number, err)
+	}
+}
+
+// WaitTurn blocks until every block before the given one is finished, so that
+// the parallel workers hand their output to the saver in block order. It
+// returns false if the watermark is closed before the turn comes.
+func (s *BlockWatermark) WaitTurn(number uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for number > s.next && !s.closed {
+		s.cond.Wait()
+	}
+	return number <= s.next
+}
+
+// Close wakes up every worker still waiting for its turn.
+func (s *BlockWatermark) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// Complete marks a block as finished and moves the checkpoint forward when
+// the block closes the gap at the bottom of the finished set.
+func (s *BlockWatermark) Complete(number uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if number < s.next || s.done[number] {
+		return
+	}
+	if number > s.next {
+		s.done[number] = true
+		if err := s.db.Put(doneBlockKey(number), []byte{}); err != nil {
+			log.Errorf("put done block %v error %v", number, err)
+		}
+		return
+	}
+	s.next++
+	s.advance()
+	s.cond.Broadcast()
+}
+
+func (s *BlockWatermark) advance() {
+	var passed []uint64
+	for s.done[s.next] {
+		delete(s.done, s.next)
+		passed = append(passed, s.next)
+		s.next++
+	}
+	//先写checkpoint再删除标记, 中途退出时重启也会清理掉checkpoint之前的标记
+	s.checkpoint(s.next)
+	for _, number := range passed {
+		if err := s.db.Delete(doneBlockKey(number)); err != nil {
+			log.Errorf("delete done block %v error %v", number, err)
+		}
+	}
+}
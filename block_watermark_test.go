@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestBlockWatermark(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	var checkpoint uint64
+	watermark := NewBlockWatermark(db, 10, func(block uint64) { checkpoint = block })
+
+	watermark.Complete(12)
+	watermark.Complete(11)
+	if checkpoint != 10 || watermark.Next() != 10 {
+		t.Fatalf("checkpoint moved over unfinished block 10: %v", checkpoint)
+	}
+
+	//模拟重启, 提前完成的区块不丢失
+	restarted := NewBlockWatermark(db, checkpoint, func(block uint64) { checkpoint = block })
+	if !restarted.DoneAhead(11) || !restarted.DoneAhead(12) || restarted.DoneAhead(13) {
+		t.Fatalf("finished blocks lost after restart")
+	}
+	restarted.Complete(10)
+	if checkpoint != 13 {
+		t.Fatalf("checkpoint %v, want 13", checkpoint)
+	}
+	if restarted.DoneAhead(11) {
+		t.Fatalf("block 11 should be below the checkpoint")
+	}
+}
+
+func TestBlockWatermarkWaitTurn(t *testing.T) {
+	watermark := NewBlockWatermark(rawdb.NewMemoryDatabase(), 0, func(block uint64) {})
+	saved := make(chan uint64, 3)
+	for _, number := range []uint64{2, 1, 0} {
+		go func(number uint64) {
+			watermark.WaitTurn(number)
+			saved <- number
+			watermark.Complete(number)
+		}(number)
+	}
+	for want := uint64(0); want < 3; want++ {
+		if got := <-saved; got != want {
+			t.Fatalf("saved block %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+var errTraceTimeout = errors.New("execution timeout")
+
+// callFrame is a call of the trace, it marshals to the same JSON as a frame of
+// the callTracer of go-ethereum.
+type callFrame struct {
+	Type    string          `json:"type"`
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Value   *hexutil.Big    `json:"value,omitempty"`
+	Gas     *hexutil.Uint64 `json:"gas,omitempty"`
+	GasUsed *hexutil.Uint64 `json:"gasUsed,omitempty"`
+	Input   *hexutil.Bytes  `json:"input,omitempty"`
+	Output  *hexutil.Bytes  `json:"output,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Time    string          `json:"time,omitempty"`
+	Calls   []*callFrame    `json:"calls,omitempty"`
+
+	//执行中的临时数据, 返回时用来计算gasUsed和output
+	gasIn   uint64
+	gasCost uint64
+	outOff  uint64
+	outLen  uint64
+	//这个调用发出的日志在交易中的序号, 不包括被回滚的日志
+	logs []int
+}
+
+func newHexUint64(value uint64) *hexutil.Uint64 {
+	v := hexutil.Uint64(value)
+	return &v
+}
+
+func newHexBytes(value []byte) *hexutil.Bytes {
+	v := hexutil.Bytes(value)
+	return &v
+}
+
+func hexAddress(address common.Address) string {
+	return hexutil.Encode(address.Bytes())
+}
+
+// memorySlice copies memory[start:end], empty when out of bounds.
+func memorySlice(memory *vm.Memory, start uint64, end uint64) []byte {
+	data := memory.Data()
+	if start > end || end > uint64(len(data)) {
+		return []byte{}
+	}
+	return common.CopyBytes(data[start:end])
+}
+
+// CallTracer is a native port of the callTracer of go-ethereum v1.9.14. It
+// builds the same call tree without the JavaScript VM, and its SELFDESTRUCT
+// frames carry the destroyed contract (from), the beneficiary (to) and the
+// balance swept to it (value).
+type CallTracer struct {
+	callstack []*callFrame
+	descended bool
+	logFrames []*callFrame // 按执行顺序, 每个LOG操作所在的调用
+
+	typ     string
+	from    common.Address
+	to      common.Address
+	input   []byte
+	gas     uint64
+	value   *big.Int
+	output  []byte
+	gasUsed uint64
+	elapsed time.Duration
+	callErr error
+
+	stopped   uint32
+	interrupt uint32
+	reason    error
+	err       error
+}
+
+func NewCallTracer() *CallTracer {
+	return &CallTracer{callstack: []*callFrame{{}}}
+}
+
+// Stop aborts the trace, GetResult returns the reason. Only the first call
+// takes effect.
+func (s *CallTracer) Stop(err error) {
+	//reason 在 interrupt 之前写入, 重复调用不能再写
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return
+	}
+	s.reason = err
+	atomic.StoreUint32(&s.interrupt, 1)
+}
+
+func (s *CallTracer) top() *callFrame {
+	return s.callstack[len(s.callstack)-1]
+}
+
+func (s *CallTracer) push(call *callFrame) {
+	s.callstack = append(s.callstack, call)
+}
+
+func (s *CallTracer) pop() *callFrame {
+	call := s.top()
+	s.callstack = s.callstack[:len(s.callstack)-1]
+	return call
+}
+
+func (s *CallTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	s.typ = "CALL"
+	if create {
+		s.typ = "CREATE"
+	}
+	s.from = from
+	s.to = to
+	s.input = common.CopyBytes(input)
+	s.gas = gas
+	s.value = new(big.Int).Set(value)
+	return nil
+}
+
+func (s *CallTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if s.err != nil {
+		return nil
+	}
+	if atomic.LoadUint32(&s.interrupt) > 0 {
+		s.err = s.reason
+		env.Cancel()
+		return nil
+	}
+	if err != nil {
+		s.fault(err)
+		return nil
+	}
+	//只关心0xf0开头的系统操作
+	syscall := op&0xf0 == 0xf0
+	if syscall && (op == vm.CREATE || op == vm.CREATE2) {
+		inOff := stack.Back(1).Uint64()
+		inEnd := inOff + stack.Back(2).Uint64()
+		s.push(&callFrame{
+			Type:    op.String(),
+			From:    hexAddress(contract.Address()),
+			Input:   newHexBytes(memorySlice(memory, inOff, inEnd)),
+			gasIn:   gas,
+			gasCost: cost,
+			Value:   (*hexutil.Big)(new(big.Int).Set(stack.Back(0))),
+		})
+		s.descended = true
+		return nil
+	}
+	if syscall && op == vm.SELFDESTRUCT {
+		//余额在操作执行前读取, 就是受益人收到的数额
+		s.top().Calls = append(s.top().Calls, &callFrame{
+			Type:  op.String(),
+			From:  hexAddress(contract.Address()),
+			To:    hexAddress(common.BigToAddress(stack.Back(0))),
+			Value: (*hexutil.Big)(env.StateDB.GetBalance(contract.Address())),
+		})
+		return nil
+	}
+	if syscall && (op == vm.CALL || op == vm.CALLCODE || op == vm.DELEGATECALL || op == vm.STATICCALL) {
+		to := common.BigToAddress(stack.Back(1))
+		//和callTracer一样跳过预编译合约
+		if _, ok := vm.PrecompiledContractsIstanbul[to]; ok {
+			return nil
+		}
+		off := 1
+		if op == vm.DELEGATECALL || op == vm.STATICCALL {
+			off = 0
+		}
+		inOff := stack.Back(2 + off).Uint64()
+		inEnd := inOff + stack.Back(3+off).Uint64()
+		call := &callFrame{
+			Type:    op.String(),
+			From:    hexAddress(contract.Address()),
+			To:      hexAddress(to),
+			Input:   newHexBytes(memorySlice(memory, inOff, inEnd)),
+			gasIn:   gas,
+			gasCost: cost,
+			outOff:  stack.Back(4 + off).Uint64(),
+			outLen:  stack.Back(5 + off).Uint64(),
+		}
+		if op != vm.DELEGATECALL && op != vm.STATICCALL {
+			call.Value = (*hexutil.Big)(new(big.Int).Set(stack.Back(2)))
+		}
+		s.push(call)
+		s.descended = true
+		return nil
+	}
+	//刚进入内层调用, 取实际得到的gas
+	if s.descended {
+		if depth >= len(s.callstack) {
+			s.top().Gas = newHexUint64(gas)
+		}
+		s.descended = false
+	}
+	if syscall && op == vm.REVERT {
+		s.top().Error = "execution reverted"
+		return nil
+	}
+	if depth == len(s.callstack)-1 {
+		//内层调用返回
+		call := s.pop()
+		if call.Type == vm.CREATE.String() || call.Type == vm.CREATE2.String() {
+			call.GasUsed = newHexUint64(call.gasIn - call.gasCost - gas)
+			if ret := stack.Back(0); ret.Sign() != 0 {
+				address := common.BigToAddress(ret)
+				call.To = hexAddress(address)
+				call.Output = newHexBytes(common.CopyBytes(env.StateDB.GetCode(address)))
+			} else if call.Error == "" {
+				call.Error = "internal failure"
+			}
+		} else if call.Gas != nil {
+			call.GasUsed = newHexUint64(call.gasIn - call.gasCost + uint64(*call.Gas) - gas)
+			if ret := stack.Back(0); ret.Sign() != 0 {
+				call.Output = newHexBytes(memorySlice(memory, call.outOff, call.outOff+call.outLen))
+			} else if call.Error == "" {
+				call.Error = "internal failure"
+			}
+		}
+		s.top().Calls = append(s.top().Calls, call)
+	}
+	if op >= vm.LOG0 && op <= vm.LOG4 {
+		s.logFrames = append(s.logFrames, s.top())
+	}
+	return nil
+}
+
+func (s *CallTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if s.err != nil {
+		return nil
+	}
+	s.fault(err)
+	return nil
+}
+
+func (s *CallTracer) fault(err error) {
+	//已经revert的调用不再处理
+	if s.top().Error != "" {
+		return
+	}
+	call := s.pop()
+	call.Error = err.Error()
+	if call.Gas != nil {
+		call.GasUsed = call.Gas
+	}
+	if len(s.callstack) > 0 {
+		s.top().Calls = append(s.top().Calls, call)
+		return
+	}
+	//最外层也失败了
+	s.push(call)
+}
+
+func (s *CallTracer) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	s.output = common.CopyBytes(output)
+	s.gasUsed = gasUsed
+	s.elapsed = t
+	s.callErr = err
+	return nil
+}
+
+// GetResult returns the call tree of the transaction, or the reason the trace
+// was stopped.
+func (s *CallTracer) GetResult() (*callFrame, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	result := &callFrame{
+		Type:    s.typ,
+		From:    hexAddress(s.from),
+		To:      hexAddress(s.to),
+		Value:   (*hexutil.Big)(s.value),
+		Gas:     newHexUint64(s.gas),
+		GasUsed: newHexUint64(s.gasUsed),
+		Input:   newHexBytes(s.input),
+		Output:  newHexBytes(s.output),
+		Time:    s.elapsed.String(),
+		Calls:   s.callstack[0].Calls,
+	}
+	if result.Value == nil {
+		result.Value = (*hexutil.Big)(new(big.Int))
+	}
+	if s.callstack[0].Error != "" {
+		result.Error = s.callstack[0].Error
+	} else if s.callErr != nil {
+		result.Error = s.callErr.Error()
+	}
+	if result.Error != "" {
+		result.Output = nil
+	}
+	s.assignLogs(result)
+	return result, nil
+}
+
+// assignLogs numbers the logs of the frames that were not reverted, in the
+// order they appear in the receipt.
+func (s *CallTracer) assignLogs(result *callFrame) {
+	reverted := map[*callFrame]bool{}
+	var walk func(frame *callFrame, failed bool)
+	walk = func(frame *callFrame, failed bool) {
+		failed = failed || frame.Error != ""
+		reverted[frame] = failed
+		for _, child := range frame.Calls {
+			walk(child, failed)
+		}
+	}
+	walk(result, false)
+	index := 0
+	for _, frame := range s.logFrames {
+		//最外层的日志记在占位的调用上
+		if frame == s.callstack[0] {
+			frame = result
+		}
+		if reverted[frame] {
+			continue
+		}
+		frame.logs = append(frame.logs, index)
+		index++
+	}
+}
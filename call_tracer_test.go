@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// jsCallTracerCode is the JavaScript callTracer the exporter used before the
+// native CallTracer, which must produce the same output. It is the stock
+// callTracer of go-ethereum with the SELFDESTRUCT frames carrying from, to
+// and value.
+const jsCallTracerCode = `{
+	// callstack is the current recursive call stack of the EVM execution.
+	callstack: [{}],
+
+	// descended tracks whether we've just descended from an outer transaction into
+	// an inner call.
+	descended: false,
+
+	// step is invoked for every opcode that the VM executes.
+	step: function(log, db) {
+		// Capture any errors immediately
+		var error = log.getError();
+		if (error !== undefined) {
+			this.fault(log, db);
+			return;
+		}
+		// We only care about system opcodes, faster if we pre-check once
+		var syscall = (log.op.toNumber() & 0xf0) == 0xf0;
+		if (syscall) {
+			var op = log.op.toString();
+		}
+		// If a new contract is being created, add to the call stack
+		if (syscall && (op == 'CREATE' || op == "CREATE2")) {
+			var inOff = log.stack.peek(1).valueOf();
+			var inEnd = inOff + log.stack.peek(2).valueOf();
+
+			// Assemble the internal call report and store for completion
+			var call = {
+				type:    op,
+				from:    toHex(log.contract.getAddress()),
+				input:   toHex(log.memory.slice(inOff, inEnd)),
+				gasIn:   log.getGas(),
+				gasCost: log.getCost(),
+				value:   '0x' + log.stack.peek(0).toString(16)
+			};
+			this.callstack.push(call);
+			this.descended = true
+			return;
+		}
+		// If a contract is being self destructed, gather that as a subcall too
+		if (syscall && op == 'SELFDESTRUCT') {
+			var left = this.callstack.length;
+			if (this.callstack[left-1].calls === undefined) {
+				this.callstack[left-1].calls = [];
+			}
+			// The balance is read before the opcode runs, it is what the beneficiary receives
+			var contract = log.contract.getAddress();
+			this.callstack[left-1].calls.push({
+				type:  op,
+				from:  toHex(contract),
+				to:    toHex(toAddress(log.stack.peek(0).toString(16))),
+				value: '0x' + db.getBalance(contract).toString(16)
+			});
+			return
+		}
+		// If a new method invocation is being done, add to the call stack
+		if (syscall && (op == 'CALL' || op == 'CALLCODE' || op == 'DELEGATECALL' || op == 'STATICCALL')) {
+			// Skip any pre-compile invocations, those are just fancy opcodes
+			var to = toAddress(log.stack.peek(1).toString(16));
+			if (isPrecompiled(to)) {
+				return
+			}
+			var off = (op == 'DELEGATECALL' || op == 'STATICCALL' ? 0 : 1);
+
+			var inOff = log.stack.peek(2 + off).valueOf();
+			var inEnd = inOff + log.stack.peek(3 + off).valueOf();
+
+			// Assemble the internal call report and store for completion
+			var call = {
+				type:    op,
+				from:    toHex(log.contract.getAddress()),
+				to:      toHex(to),
+				input:   toHex(log.memory.slice(inOff, inEnd)),
+				gasIn:   log.getGas(),
+				gasCost: log.getCost(),
+				outOff:  log.stack.peek(4 + off).valueOf(),
+				outLen:  log.stack.peek(5 + off).valueOf()
+			};
+			if (op != 'DELEGATECALL' && op != 'STATICCALL') {
+				call.value = '0x' + log.stack.peek(2).toString(16);
+			}
+			this.callstack.push(call);
+			this.descended = true
+			return;
+		}
+		// If we've just descended into an inner call, retrieve it's true allowance. We
+		// need to extract if from within the call as there may be funky gas dynamics
+		// with regard to requested and actually given gas (2300 stipend, 63/64 rule).
+		if (this.descended) {
+			if (log.getDepth() >= this.callstack.length) {
+				this.callstack[this.callstack.length - 1].gas = log.getGas();
+			} else {
+				// TODO(karalabe): The call was made to a plain account. We currently don't
+				// have access to the true gas amount inside the call and so any amount will
+				// mostly be wrong since it depends on a lot of input args. Skip gas for now.
+			}
+			this.descended = false;
+		}
+		// If an existing call is returning, pop off the call stack
+		if (syscall && op == 'REVERT') {
+			this.callstack[this.callstack.length - 1].error = "execution reverted";
+			return;
+		}
+		if (log.getDepth() == this.callstack.length - 1) {
+			// Pop off the last call and get the execution results
+			var call = this.callstack.pop();
+
+			if (call.type == 'CREATE' || call.type == "CREATE2") {
+				// If the call was a CREATE, retrieve the contract address and output code
+				call.gasUsed = '0x' + bigInt(call.gasIn - call.gasCost - log.getGas()).toString(16);
+				delete call.gasIn; delete call.gasCost;
+
+				var ret = log.stack.peek(0);
+				if (!ret.equals(0)) {
+					call.to     = toHex(toAddress(ret.toString(16)));
+					call.output = toHex(db.getCode(toAddress(ret.toString(16))));
+				} else if (call.error === undefined) {
+					call.error = "internal failure"; // TODO(karalabe): surface these faults somehow
+				}
+			} else {
+				// If the call was a contract call, retrieve the gas usage and output
+				if (call.gas !== undefined) {
+					call.gasUsed = '0x' + bigInt(call.gasIn - call.gasCost + call.gas - log.getGas()).toString(16);
+
+					var ret = log.stack.peek(0);
+					if (!ret.equals(0)) {
+						call.output = toHex(log.memory.slice(call.outOff, call.outOff + call.outLen));
+					} else if (call.error === undefined) {
+						call.error = "internal failure"; // TODO(karalabe): surface these faults somehow
+					}
+				}
+				delete call.gasIn; delete call.gasCost;
+				delete call.outOff; delete call.outLen;
+			}
+			if (call.gas !== undefined) {
+				call.gas = '0x' + bigInt(call.gas).toString(16);
+			}
+			// Inject the call into the previous one
+			var left = this.callstack.length;
+			if (this.callstack[left-1].calls === undefined) {
+				this.callstack[left-1].calls = [];
+			}
+			this.callstack[left-1].calls.push(call);
+		}
+	},
+
+	// fault is invoked when the actual execution of an opcode fails.
+	fault: function(log, db) {
+		// If the topmost call already reverted, don't handle the additional fault again
+		if (this.callstack[this.callstack.length - 1].error !== undefined) {
+			return;
+		}
+		// Pop off the just failed call
+		var call = this.callstack.pop();
+		call.error = log.getError();
+
+		// Consume all available gas and clean any leftovers
+		if (call.gas !== undefined) {
+			call.gas = '0x' + bigInt(call.gas).toString(16);
+			call.gasUsed = call.gas
+		}
+		delete call.gasIn; delete call.gasCost;
+		delete call.outOff; delete call.outLen;
+
+		// Flatten the failed call into its parent
+		var left = this.callstack.length;
+		if (left > 0) {
+			if (this.callstack[left-1].calls === undefined) {
+				this.callstack[left-1].calls = [];
+			}
+			this.callstack[left-1].calls.push(call);
+			return;
+		}
+		// Last call failed too, leave it in the stack
+		this.callstack.push(call);
+	},
+
+	// result is invoked when all the opcodes have been iterated over and returns
+	// the final result of the tracing.
+	result: function(ctx, db) {
+		var result = {
+			type:    ctx.type,
+			from:    toHex(ctx.from),
+			to:      toHex(ctx.to),
+			value:   '0x' + ctx.value.toString(16),
+			gas:     '0x' + bigInt(ctx.gas).toString(16),
+			gasUsed: '0x' + bigInt(ctx.gasUsed).toString(16),
+			input:   toHex(ctx.input),
+			output:  toHex(ctx.output),
+			time:    ctx.time,
+		};
+		if (this.callstack[0].calls !== undefined) {
+			result.calls = this.callstack[0].calls;
+		}
+		if (this.callstack[0].error !== undefined) {
+			result.error = this.callstack[0].error;
+		} else if (ctx.error !== undefined) {
+			result.error = ctx.error;
+		}
+		if (result.error !== undefined) {
+			delete result.output;
+		}
+		return this.finalize(result);
+	},
+
+	// finalize recreates a call object using the final desired field oder for json
+	// serialization. This is a nicety feature to pass meaningfully ordered results
+	// to users who don't interpret it, just display it.
+	finalize: function(call) {
+		var sorted = {
+			type:    call.type,
+			from:    call.from,
+			to:      call.to,
+			value:   call.value,
+			gas:     call.gas,
+			gasUsed: call.gasUsed,
+			input:   call.input,
+			output:  call.output,
+			error:   call.error,
+			time:    call.time,
+			calls:   call.calls,
+		}
+		for (var key in sorted) {
+			if (sorted[key] === undefined) {
+				delete sorted[key];
+			}
+		}
+		if (sorted.calls !== undefined) {
+			for (var i=0; i<sorted.calls.length; i++) {
+				sorted.calls[i] = this.finalize(sorted.calls[i]);
+			}
+		}
+		return sorted;
+	}
+}`
+
+// asm assembles opcodes, pushing ints, byte slices and addresses.
+func asm(items ...interface{}) []byte {
+	var code []byte
+	push := func(data []byte) {
+		if len(data) == 0 {
+			data = []byte{0}
+		}
+		code = append(code, byte(vm.PUSH1)+byte(len(data)-1))
+		code = append(code, data...)
+	}
+	for _, item := range items {
+		switch v := item.(type) {
+		case vm.OpCode:
+			code = append(code, byte(v))
+		case int:
+			push(big.NewInt(int64(v)).Bytes())
+		case []byte:
+			push(v)
+		case common.Address:
+			push(v.Bytes())
+		case []interface{}:
+			code = append(code, asm(v...)...)
+		}
+	}
+	return code
+}
+
+// asmCall calls a contract and drops the result, gas is an int or vm.GAS.
+func asmCall(op vm.OpCode, gas interface{}, to common.Address, value int, inOff int, inSize int, outOff int, outSize int) []interface{} {
+	items := []interface{}{outSize, outOff, inSize, inOff}
+	if op == vm.CALL || op == vm.CALLCODE {
+		items = append(items, value)
+	}
+	return append(items, to, gas, op, vm.POP)
+}
+
+var (
+	tracerSender       = common.HexToAddress("0x5e")
+	tracerCaller       = common.HexToAddress("0xaa")
+	tracerStopper      = common.HexToAddress("0xbb")
+	tracerReverter     = common.HexToAddress("0xcc")
+	tracerInvalid      = common.HexToAddress("0xdd")
+	tracerDestructor   = common.HexToAddress("0xee")
+	tracerReturner     = common.HexToAddress("0xab")
+	tracerAccount      = common.HexToAddress("0xe0")
+	tracerBeneficiary  = common.HexToAddress("0xbe")
+	tracerIdentity     = common.HexToAddress("0x04")
+	tracerLogger       = common.HexToAddress("0x1a")
+	tracerRevertLogger = common.HexToAddress("0x1b")
+	tracerLeafLogger   = common.HexToAddress("0x1c")
+	tracerInitCode     = asm(0, 0, vm.MSTORE8, 1, 0, vm.RETURN)
+	tracerRevertedInit = asm(0, 0, vm.REVERT)
+)
+
+func newTracerState(t *testing.T) *state.StateDB {
+	statedb, err := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statedb.SetBalance(tracerSender, big.NewInt(params.Ether))
+	statedb.SetBalance(tracerCaller, big.NewInt(100))
+	statedb.SetBalance(tracerDestructor, big.NewInt(7))
+	statedb.SetCode(tracerStopper, asm(vm.STOP))
+	statedb.SetCode(tracerReverter, asm(0, 0, vm.REVERT))
+	statedb.SetCode(tracerInvalid, []byte{0xfe})
+	statedb.SetCode(tracerDestructor, asm(tracerBeneficiary, vm.SELFDESTRUCT))
+	statedb.SetCode(tracerReturner, asm(0x2a, 0, vm.MSTORE, 0x20, 0, vm.RETURN))
+	statedb.SetCode(tracerRevertLogger, asm(0, 0, vm.LOG0, 0, 0, vm.REVERT))
+	statedb.SetCode(tracerLeafLogger, asm(0, 0, vm.LOG0, 0, 0, vm.LOG0))
+	statedb.SetCode(tracerLogger, asm(
+		0, 0, vm.LOG0,
+		asmCall(vm.CALL, vm.GAS, tracerRevertLogger, 0, 0, 0, 0, 0),
+		//调用返回后的第一个操作就是LOG
+		0, 0, 0, 0, 0, 0, tracerLeafLogger, vm.GAS, vm.CALL, vm.LOG0,
+	))
+	statedb.SetCode(tracerCaller, asm(
+		asmCall(vm.CALL, vm.GAS, tracerStopper, 1, 0, 0, 0, 0),
+		asmCall(vm.CALL, vm.GAS, tracerAccount, 2, 0, 0, 0, 0),
+		asmCall(vm.CALL, vm.GAS, tracerReturner, 0, 0, 0, 0, 0x20),
+		asmCall(vm.CALLCODE, vm.GAS, tracerReturner, 0, 0, 0, 0, 0x20),
+		asmCall(vm.DELEGATECALL, vm.GAS, tracerReturner, 0, 0, 0, 0, 0x20),
+		asmCall(vm.STATICCALL, vm.GAS, tracerReturner, 0, 0, 4, 0, 0x20),
+		asmCall(vm.CALL, vm.GAS, tracerIdentity, 0, 0, 0x20, 0, 0x20),
+		asmCall(vm.CALL, vm.GAS, tracerReverter, 0, 0, 0, 0, 0),
+		asmCall(vm.CALL, 0x1000, tracerInvalid, 0, 0, 0, 0, 0),
+		asmCall(vm.CALL, vm.GAS, tracerDestructor, 0, 0, 0, 0, 0),
+		//CREATE, CREATE2 和初始化失败的 CREATE
+		tracerInitCode, 0, vm.MSTORE,
+		len(tracerInitCode), 32-len(tracerInitCode), 3, vm.CREATE, vm.POP,
+		1, len(tracerInitCode), 32-len(tracerInitCode), 0, vm.CREATE2, vm.POP,
+		tracerRevertedInit, 0x40, vm.MSTORE,
+		len(tracerRevertedInit), 0x60-len(tracerRevertedInit), 0, vm.CREATE, vm.POP,
+		vm.STOP,
+	))
+	return statedb
+}
+
+// runTracer executes a message from tracerSender with the tracer.
+func runTracer(t *testing.T, tracer vm.Tracer, to *common.Address, value int64, data []byte) {
+	statedb := newTracerState(t)
+	vmctx := vm.Context{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GetHash:     func(uint64) common.Hash { return common.Hash{} },
+		Origin:      tracerSender,
+		Coinbase:    common.HexToAddress("0xc0"),
+		BlockNumber: big.NewInt(10000000),
+		Time:        big.NewInt(1600000000),
+		Difficulty:  big.NewInt(1),
+		GasLimit:    10000000,
+		GasPrice:    big.NewInt(1),
+	}
+	msg := types.NewMessage(tracerSender, to, 0, big.NewInt(value), 3000000, big.NewInt(1), data, false)
+	evm := vm.NewEVM(vmctx, statedb, params.MainnetChainConfig, vm.Config{Debug: true, Tracer: tracer})
+	if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.Gas())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func unmarshalTrace(t *testing.T, data []byte) map[string]interface{} {
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	delete(result, "time")
+	return result
+}
+
+// stockSelfDestructFrames reduces the SELFDESTRUCT frames of a trace to what
+// the stock callTracer reports for them, the type only.
+func stockSelfDestructFrames(result map[string]interface{}) map[string]interface{} {
+	calls, ok := result["calls"].([]interface{})
+	if !ok {
+		return result
+	}
+	for i, call := range calls {
+		frame := call.(map[string]interface{})
+		if frame["type"] == "SELFDESTRUCT" {
+			calls[i] = map[string]interface{}{"type": "SELFDESTRUCT"}
+			continue
+		}
+		calls[i] = stockSelfDestructFrames(frame)
+	}
+	return result
+}
+
+func TestCallTracerParity(t *testing.T) {
+	caseList := []struct {
+		name  string
+		to    *common.Address
+		value int64
+		data  []byte
+	}{
+		{"transfer", &tracerAccount, 5, nil},
+		{"calls", &tracerCaller, 0, []byte{1, 2, 3}},
+		{"revert", &tracerReverter, 0, nil},
+		{"fault", &tracerInvalid, 0, nil},
+		{"selfdestruct", &tracerDestructor, 1, nil},
+		{"create", nil, 3, tracerInitCode},
+		{"create reverted", nil, 0, tracerRevertedInit},
+	}
+	for _, c := range caseList {
+		jsTracer, err := tracers.New(jsCallTracerCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTracer(t, jsTracer, c.to, c.value, c.data)
+		jsResult, err := jsTracer.GetResult()
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+
+		tracer := NewCallTracer()
+		runTracer(t, tracer, c.to, c.value, c.data)
+		frame, err := tracer.GetResult()
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		result, _ := json.Marshal(frame)
+
+		if !reflect.DeepEqual(unmarshalTrace(t, jsResult), unmarshalTrace(t, result)) {
+			t.Fatalf("%v:\njs     %s\nnative %s", c.name, jsResult, result)
+		}
+
+		//除了 SELFDESTRUCT, 和 go-ethereum 自带的 callTracer 一致
+		stockTracer, err := tracers.New("callTracer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTracer(t, stockTracer, c.to, c.value, c.data)
+		stockResult, err := stockTracer.GetResult()
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(unmarshalTrace(t, stockResult), stockSelfDestructFrames(unmarshalTrace(t, result))) {
+			t.Fatalf("%v:\nstock  %s\nnative %s", c.name, stockResult, result)
+		}
+	}
+}
+
+func TestCallTracerSelfDestruct(t *testing.T) {
+	tracer := NewCallTracer()
+	runTracer(t, tracer, &tracerDestructor, 1, nil)
+	frame, err := tracer.GetResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//余额包含这笔交易转入的 1
+	if len(frame.Calls) != 1 || frame.Calls[0].To != hexAddress(tracerBeneficiary) || frame.Calls[0].Value.ToInt().Int64() != 8 {
+		t.Fatalf("got %+v", frame.Calls)
+	}
+}
+
+func TestCallTracerStop(t *testing.T) {
+	tracer := NewCallTracer()
+	tracer.Stop(errTraceTimeout)
+	runTracer(t, tracer, &tracerCaller, 0, nil)
+	if _, err := tracer.GetResult(); err != errTraceTimeout {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCallTracerLogs(t *testing.T) {
+	tracer := NewCallTracer()
+	runTracer(t, tracer, &tracerLogger, 0, nil)
+	frame, err := tracer.GetResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//回滚的调用发出的日志不在receipt里
+	if len(frame.Calls) != 2 || !reflect.DeepEqual(frame.logs, []int{0, 3}) ||
+		frame.Calls[0].logs != nil || !reflect.DeepEqual(frame.Calls[1].logs, []int{1, 2}) {
+		t.Fatalf("got %v %+v", frame.logs, frame.Calls)
+	}
+}
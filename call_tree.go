@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// CallTreeNode is a frame of the call tree of a transaction. It keeps the
+// index of the logs the frame emitted, the token records parsed from these
+// logs are attached to it when a tree document is built.
+type CallTreeNode struct {
+	InternalIndex string          `json:"internal_index"`
+	Type          string          `json:"type"`
+	From          string          `json:"from"`
+	To            string          `json:"to"`
+	Value         *hexutil.Big    `json:"value,omitempty"`
+	Gas           *hexutil.Uint64 `json:"gas,omitempty"`
+	GasUsed       *hexutil.Uint64 `json:"gas_used,omitempty"`
+	Input         *hexutil.Bytes  `json:"input,omitempty"`
+	Output        *hexutil.Bytes  `json:"output,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	LogIndexList  []uint64        `json:"log_index_list,omitempty"` // 这个调用发出的日志在区块中的序号
+	Transfers     []Transaction   `json:"transfers,omitempty"`      // 从这些日志解析出的代币记录
+	Calls         []*CallTreeNode `json:"calls,omitempty"`
+}
+
+// newCallTreeNode converts a traced frame and its children, the logs of the
+// frames are looked up in the receipt, which may be nil.
+func newCallTreeNode(frame *callFrame, internalIndex string, receipt *types.Receipt) *CallTreeNode {
+	node := &CallTreeNode{
+		InternalIndex: internalIndex,
+		Type:          frame.Type,
+		From:          frame.From,
+		To:            frame.To,
+		Value:         frame.Value,
+		Gas:           frame.Gas,
+		GasUsed:       frame.GasUsed,
+		Input:         frame.Input,
+		Output:        frame.Output,
+		Error:         frame.Error,
+	}
+	if receipt != nil {
+		for _, index := range frame.logs {
+			if index < len(receipt.Logs) {
+				node.LogIndexList = append(node.LogIndexList, uint64(receipt.Logs[index].Index))
+			}
+		}
+	}
+	for i, child := range frame.Calls {
+		node.Calls = append(node.Calls, newCallTreeNode(child, fmt.Sprintf("%v_%v", internalIndex, i), receipt))
+	}
+	return node
+}
+
+// attachTransfers returns a copy of the tree with each token record attached
+// to the frame that emitted its log, the records of no frame are returned.
+func (s *CallTreeNode) attachTransfers(transfers map[uint64][]Transaction) *CallTreeNode {
+	node := *s
+	node.Transfers = nil
+	for _, logIndex := range s.LogIndexList {
+		node.Transfers = append(node.Transfers, transfers[logIndex]...)
+		delete(transfers, logIndex)
+	}
+	node.Calls = nil
+	for _, child := range s.Calls {
+		node.Calls = append(node.Calls, child.attachTransfers(transfers))
+	}
+	return &node
+}
+
+// TransactionTree is the document of a transaction in the tree sink format:
+// the top level record with the nested call tree, the token records attached
+// to the frames that emitted them, and the receipt.
+type TransactionTree struct {
+	Transaction
+	CallTree  *CallTreeNode  `json:"call_tree"`
+	Receipt   *types.Receipt `json:"receipt"`
+	Transfers []Transaction  `json:"transfers"` // 没有调用树时的代币记录
+
+	transactionList []Transaction
+}
+
+// BuildTransactionTrees groups the records by transaction, in the order they
+// come, into one document per transaction.
+func BuildTransactionTrees(transactionList []Transaction) []*TransactionTree {
+	type treeKey struct {
+		blockHash string
+		hash      string
+		removed   bool
+	}
+	var treeList []*TransactionTree
+	trees := map[treeKey]*TransactionTree{}
+	for _, transaction := range transactionList {
+		key := treeKey{transaction.BlockHash, transaction.Hash, transaction.Removed}
+		tree, ok := trees[key]
+		if !ok {
+			tree = &TransactionTree{Transaction: transaction}
+			trees[key] = tree
+			treeList = append(treeList, tree)
+		}
+		tree.transactionList = append(tree.transactionList, transaction)
+	}
+	for _, tree := range treeList {
+		transfers := map[uint64][]Transaction{}
+		var logIndexList []uint64
+		for _, transaction := range tree.transactionList {
+			if transaction.LogIndex.Sign() >= 0 {
+				logIndex := transaction.LogIndex.Uint64()
+				if _, ok := transfers[logIndex]; !ok {
+					logIndexList = append(logIndexList, logIndex)
+				}
+				transfers[logIndex] = append(transfers[logIndex], stripCallTree(transaction))
+			} else if transaction.InternalIndex == InternalIndexDefault && transaction.TokenType != TokenTypeContractCreation {
+				tree.Transaction = transaction
+			}
+		}
+		tree.Receipt = tree.Transaction.Receipt
+		if tree.Transaction.CallTree != nil {
+			tree.CallTree = tree.Transaction.CallTree.attachTransfers(transfers)
+		}
+		for _, logIndex := range logIndexList {
+			tree.Transfers = append(tree.Transfers, transfers[logIndex]...)
+		}
+		tree.Transaction = stripCallTree(tree.Transaction)
+	}
+	return treeList
+}
+
+// stripCallTree returns the record without the call tree and the receipt, as
+// it is exported in the flat sink format.
+func stripCallTree(transaction Transaction) Transaction {
+	transaction.CallTree = nil
+	transaction.Receipt = nil
+	return transaction
+}
+
+// stripCallTreeList returns the records without their call trees and
+// receipts, the journal and the dead letters do not persist them.
+func stripCallTreeList(transactionList []Transaction) []Transaction {
+	if transactionList == nil {
+		return nil
+	}
+	strippedList := make([]Transaction, len(transactionList))
+	for i, transaction := range transactionList {
+		strippedList[i] = stripCallTree(transaction)
+	}
+	return strippedList
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestBuildTransactionTrees(t *testing.T) {
+	trace := &callFrame{Type: "CALL", From: "0x0a", To: "0xc1", logs: []int{1}, Calls: []*callFrame{
+		{Type: "CALL", From: "0xc1", To: "0xc2", logs: []int{0}},
+	}}
+	receipt := &types.Receipt{Logs: []*types.Log{{Index: 7}, {Index: 8}}}
+	transaction := Transaction{Hash: "0x01", BlockHash: "0xb1", LogIndex: *LogIndexDefault, InternalIndex: InternalIndexDefault}
+	transaction.CallTree = newCallTreeNode(trace, InternalIndexDefault, receipt)
+	transaction.Receipt = receipt
+	transfer := func(hash string, logIndex int64) Transaction {
+		return Transaction{Hash: hash, BlockHash: "0xb1", LogIndex: *big.NewInt(logIndex), InternalIndex: InternalIndexDefault, TokenType: TokenTypeToken}
+	}
+	//代币记录排在交易本身的记录之前
+	transactionList := []Transaction{
+		transfer("0x01", 7), transfer("0x01", 8), transaction,
+		transfer("0x02", 9), {Hash: "0x02", BlockHash: "0xb1", LogIndex: *LogIndexDefault, InternalIndex: InternalIndexDefault},
+	}
+
+	treeList := BuildTransactionTrees(transactionList)
+	if len(treeList) != 2 || len(treeList[0].transactionList) != 3 || len(treeList[1].transactionList) != 2 {
+		t.Fatalf("got %v trees", len(treeList))
+	}
+	tree := treeList[0]
+	if tree.TokenType != TokenTypeDefault || tree.Transaction.CallTree != nil || tree.Receipt != receipt || tree.Transfers != nil {
+		t.Fatalf("got %+v", tree)
+	}
+	if len(tree.CallTree.Transfers) != 1 || tree.CallTree.Transfers[0].LogIndex.Int64() != 8 ||
+		len(tree.CallTree.Calls[0].Transfers) != 1 || tree.CallTree.Calls[0].Transfers[0].LogIndex.Int64() != 7 ||
+		tree.CallTree.Calls[0].InternalIndex != "0_0" {
+		t.Fatalf("got %+v", tree.CallTree)
+	}
+	//挂上代币记录不修改原记录的调用树
+	if transaction.CallTree.Transfers != nil {
+		t.Fatalf("call tree of the record changed")
+	}
+	//没有调用树时代币记录放在文档上
+	if treeList[1].CallTree != nil || len(treeList[1].Transfers) != 1 || treeList[1].TokenType != TokenTypeDefault {
+		t.Fatalf("got %+v", treeList[1])
+	}
+}
+
+func TestBuildSinkDocuments(t *testing.T) {
+	appConfig := &AppConfig{SinkFormat: map[string]string{"http://a": SinkFormatTree}}
+	transactionList := []Transaction{
+		{Hash: "0x01", LogIndex: *big.NewInt(0), TokenType: TokenTypeToken},
+		{Hash: "0x01", LogIndex: *LogIndexDefault, InternalIndex: InternalIndexDefault, CallTree: &CallTreeNode{}},
+	}
+	documentList := buildSinkDocuments(appConfig, "http://a", transactionList)
+	if len(documentList) != 1 || len(documentList[0].transactionList) != 2 {
+		t.Fatalf("got %+v", documentList)
+	}
+	marshal, _ := json.Marshal(documentList[0].document)
+	if !strings.Contains(string(marshal), `"log_index":-1`) || !strings.Contains(string(marshal), `"transfers":[{`) {
+		t.Fatalf("got %s", marshal)
+	}
+	documentList = buildSinkDocuments(appConfig, "http://b", transactionList)
+	if len(documentList) != 2 || documentList[1].document.(*Transaction).CallTree != nil || transactionList[1].CallTree == nil {
+		t.Fatalf("got %+v", documentList)
+	}
+	if marshal, _ = json.Marshal(documentList[0].document); !strings.Contains(string(marshal), `"log_index":0`) {
+		t.Fatalf("got %s", marshal)
+	}
+}
@@ -1,18 +1,90 @@
 package main
 
+import (
+	"strings"
+
+	"github.com/jinzhu/configor"
+)
+
 type AppConfig struct {
-	Profile                     string   `json:"profile"`
-	BlocksGoroutineSize         int64    `json:"blocks_goroutine_size"`
-	BlocksChannelSize           int64    `json:"blocks_channel_size"`
-	TxsChannelSize              int64    `json:"txs_channel_size"`
-	LogsChannelSize             int64    `json:"logs_channel_size"`
-	ChainHeadEventChannelSize   int64    `json:"chain_head_event_channel_size"`
-	NewTxsEventChannelSize      int64    `json:"new_txs_event_channel_size"`
-	RemovedLogsEventChannelSize int64    `json:"removed_logs_event_channel_size"`
-	SubscribeEndpointList       []string `json:"subscribe_endpoint_list"`
-	Timeout                     string   `json:"timeout"`
-	Reexec                      uint64   `json:"reexec"`
-	StartBlock                  uint64   `json:"start_block"`
-	Saver                       string   `json:"saver"`
-	BatchSize                   uint64   `json:"batch_size"`
+	Profile                     string            `json:"profile"`
+	BlocksGoroutineSize         int64             `json:"blocks_goroutine_size"`
+	BlocksChannelSize           int64             `json:"blocks_channel_size"`
+	TxsChannelSize              int64             `json:"txs_channel_size"`
+	LogsChannelSize             int64             `json:"logs_channel_size"`
+	ChainHeadEventChannelSize   int64             `json:"chain_head_event_channel_size"`
+	NewTxsEventChannelSize      int64             `json:"new_txs_event_channel_size"`
+	RemovedLogsEventChannelSize int64             `json:"removed_logs_event_channel_size"`
+	SubscribeEndpointList       []string          `json:"subscribe_endpoint_list"`
+	Timeout                     string            `json:"timeout"`
+	Reexec                      uint64            `json:"reexec"`
+	StartBlock                  uint64            `json:"start_block"`
+	Saver                       string            `json:"saver"`
+	BatchSize                   uint64            `json:"batch_size"`
+	ReorgDepth                  uint64            `json:"reorg_depth"`
+	ConfirmationDepth           uint64            `json:"confirmation_depth"`
+	DeadLetterRetryInterval     string            `json:"dead_letter_retry_interval"`
+	DeadLetterMaxRetryInterval  string            `json:"dead_letter_max_retry_interval"`
+	RetraceTimeout              string            `json:"retrace_timeout"`      // 超时的交易第一次重新跟踪的超时, 之后每次加倍
+	RetraceMaxTimeout           string            `json:"retrace_max_timeout"`  // 重新跟踪的最大超时
+	RetraceMaxAttempts          uint64            `json:"retrace_max_attempts"` // 重新跟踪的最多次数, 之后放弃
+	RetraceInterval             string            `json:"retrace_interval"`     // 两次重新跟踪的间隔
+	DefaultSinkPolicy           string            `json:"default_sink_policy"`
+	SinkPolicy                  map[string]string `json:"sink_policy"` // sink(http endpoint 或者 saver 名字) => policy
+	DefaultSinkFormat           string            `json:"default_sink_format"`
+	SinkFormat                  map[string]string `json:"sink_format"` // sink => flat 或者 tree
+	WrappedTokenAddressList     []string          `json:"wrapped_token_address_list"`
+	LegacyERC721AddressList     []string          `json:"legacy_erc721_address_list"` // Transfer 参数都不是 indexed 的早期 ERC-721
+	AbiDir                      string            `json:"abi_dir"`
+	SignatureDir                string            `json:"signature_dir"`
+	InternalCallMode            string            `json:"internal_call_mode"`      // value, all 或者 types
+	InternalCallTypeList        []string          `json:"internal_call_type_list"` // types 模式下额外导出的调用类型
+}
+
+// GetSinkPolicy returns how save failures of a sink are handled: required,
+// best-effort or ignore.
+func (s *AppConfig) GetSinkPolicy(sink string) string {
+	if policy, ok := s.SinkPolicy[sink]; ok {
+		return policy
+	}
+	if s.DefaultSinkPolicy != "" {
+		return s.DefaultSinkPolicy
+	}
+	return SinkPolicyBestEffort
+}
+
+// GetSinkFormat returns the documents a sink receives: flat records, or one
+// tree per transaction.
+func (s *AppConfig) GetSinkFormat(sink string) string {
+	if format, ok := s.SinkFormat[sink]; ok {
+		return format
+	}
+	if s.DefaultSinkFormat != "" {
+		return s.DefaultSinkFormat
+	}
+	return SinkFormatFlat
+}
+
+// IsInternalCallExported tells whether a call frame without value is exported
+// as an internal record. Frames moving ETH are always exported.
+func (s *AppConfig) IsInternalCallExported(callType string) bool {
+	switch s.InternalCallMode {
+	case InternalCallModeAll:
+		return true
+	case InternalCallModeTypes:
+		for _, t := range s.InternalCallTypeList {
+			if strings.EqualFold(t, callType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func loadAppConfig(file string) (*AppConfig, error) {
+	var appConfig AppConfig
+	if err := configor.Load(&appConfig, file); err != nil {
+		return nil, err
+	}
+	return &appConfig, nil
 }
@@ -2,16 +2,41 @@ package main
 
 import "math/big"
 
-const DataVersion uint64 = 3
+const DataVersion uint64 = 16
 
 const InternalIndexDefault string = "0"
 
 const TokenTypeDefault uint64 = 0
 const TokenTypeToken uint64 = 1
+const TokenTypeERC721 uint64 = 2
+const TokenTypeERC1155 uint64 = 3
+const TokenTypeApproval uint64 = 4
+const TokenTypeEvent uint64 = 5
+const TokenTypeContractCreation uint64 = 6
+
+// 合约创建记录和交易本身、CREATE 调用的内部交易的 internal index 相同, 用 sub index 区分
+const SubIndexContractCreation uint64 = 1
+
+const OpCodeSelfDestruct string = "SELFDESTRUCT"
 
 const TransactionStatusSuccess uint64 = 0
 const TransactionStatusFailed uint64 = 1
 const TransactionStatusPending uint64 = 2
 const TransactionStatusTimeout uint64 = 3
 
+const StreamConfirmed string = "confirmed"
+const StreamUnsafe string = "unsafe"
+const StreamPending string = "pending"
+
+const SinkPolicyRequired string = "required"      // 保存成功之前区块不算完成, 一直重试
+const SinkPolicyBestEffort string = "best-effort" // 失败的数据存入dead letter队列
+const SinkPolicyIgnore string = "ignore"          // 失败只记日志
+
+const SinkFormatFlat string = "flat" // 每条记录一个文档
+const SinkFormatTree string = "tree" // 每个交易一个文档, 包含调用树, 代币记录和receipt
+
+const InternalCallModeValue string = "value" // 只导出转移了ETH的调用
+const InternalCallModeAll string = "all"     // 导出全部调用
+const InternalCallModeTypes string = "types" // 另外导出指定类型的调用, 如 DELEGATECALL
+
 var LogIndexDefault *big.Int = big.NewInt(-1)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func isCreateOpCode(opCode string) bool {
+	return opCode == "CREATE" || opCode == "CREATE2"
+}
+
+// newContractCreation returns the creation record of a contract, based on the
+// top level record of the transaction.
+func newContractCreation(parentTransaction Transaction, internalIndex string, callPath []string) Transaction {
+	return Transaction{
+		Timestamp:        parentTransaction.Timestamp,
+		BlockNumber:      parentTransaction.BlockNumber,
+		Hash:             parentTransaction.Hash,
+		Nonce:            parentTransaction.Nonce,
+		BlockHash:        parentTransaction.BlockHash,
+		TransactionIndex: parentTransaction.TransactionIndex,
+		GasPrice:         parentTransaction.GasPrice,
+		LogIndex:         *LogIndexDefault,
+		InternalIndex:    internalIndex,
+		SubIndex:         SubIndexContractCreation,
+		From:             callPath[len(callPath)-1],
+		TokenType:        TokenTypeContractCreation,
+		CallPath:         callPath,
+		Status:           parentTransaction.Status,
+	}
+}
+
+// parseContractCreations returns a record for every contract created by a
+// transaction: the top level creation and the CREATE/CREATE2 frames of the
+// call trace. The trace may be nil when tracing failed, then only the top
+// level creation is known, from the address of the receipt.
+func parseContractCreations(parentTransaction Transaction, trace *callFrame, topLevelCreation bool) []Transaction {
+	var transactionList []Transaction
+	if trace == nil {
+		if topLevelCreation {
+			transaction := newContractCreation(parentTransaction, InternalIndexDefault, []string{parentTransaction.From})
+			transaction.ContractAddress = parentTransaction.ContractAddress
+			transaction.Value = parentTransaction.Value
+			transactionList = append(transactionList, transaction)
+		}
+		return transactionList
+	}
+	var walk func(frame *callFrame, internalIndex string, callPath []string, failed bool)
+	walk = func(frame *callFrame, internalIndex string, callPath []string, failed bool) {
+		callPath = append(callPath[:len(callPath):len(callPath)], normalizeAddress(frame.From))
+		//外层调用失败时内层创建的合约也被回滚
+		failed = failed || frame.Error != ""
+		if isCreateOpCode(frame.Type) {
+			transaction := newContractCreation(parentTransaction, internalIndex, callPath)
+			transaction.OpCode = frame.Type
+			if frame.Value != nil {
+				transaction.Value = *frame.Value.ToInt()
+			}
+			if frame.To != "" && normalizeAddress(frame.To) != zeroAddress {
+				transaction.ContractAddress = normalizeAddress(frame.To)
+			}
+			if internalIndex == InternalIndexDefault && parentTransaction.ContractAddress != "" {
+				//失败的创建trace里没有地址, 以receipt为准
+				transaction.ContractAddress = parentTransaction.ContractAddress
+			}
+			if failed {
+				transaction.Status = TransactionStatusFailed
+				transaction.Err = frame.Error
+			} else {
+				transaction.Status = TransactionStatusSuccess
+				if frame.Output != nil && len(*frame.Output) > 0 {
+					transaction.CodeHash = crypto.Keccak256Hash(*frame.Output).String()
+				}
+			}
+			transactionList = append(transactionList, transaction)
+		}
+		for i, child := range frame.Calls {
+			walk(child, fmt.Sprintf("%v_%v", internalIndex, i), callPath, failed)
+		}
+	}
+	walk(trace, InternalIndexDefault, []string{}, parentTransaction.Status == TransactionStatusFailed)
+	return transactionList
+}
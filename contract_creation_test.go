@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const contractCreationTrace = `{
+	"type": "CALL", "from": "0x000000000000000000000000000000000000000a", "to": "0x00000000000000000000000000000000000000f0",
+	"calls": [
+		{"type": "CREATE2", "from": "0x00000000000000000000000000000000000000f0", "to": "0x00000000000000000000000000000000000000c1", "value": "0x5", "output": "0x6001",
+			"calls": [
+				{"type": "CREATE", "from": "0x00000000000000000000000000000000000000c1", "to": "0x00000000000000000000000000000000000000c2", "value": "0x0", "output": "0x6002"}
+			]},
+		{"type": "CALL", "from": "0x00000000000000000000000000000000000000f0", "to": "0x00000000000000000000000000000000000000f1", "error": "execution reverted",
+			"calls": [
+				{"type": "CREATE", "from": "0x00000000000000000000000000000000000000f1", "to": "0x00000000000000000000000000000000000000c3", "value": "0x0", "output": "0x6003"}
+			]}
+	]
+}`
+
+func TestParseContractCreations(t *testing.T) {
+	trace := &callFrame{}
+	if err := json.Unmarshal([]byte(contractCreationTrace), trace); err != nil {
+		t.Fatal(err)
+	}
+	parent := Transaction{
+		BlockNumber: *big.NewInt(100),
+		BlockHash:   "0x100",
+		Hash:        "0x01",
+		From:        common.HexToAddress("0x0a").String(),
+		Status:      TransactionStatusSuccess,
+	}
+	transactionList := parseContractCreations(parent, trace, false)
+	if len(transactionList) != 3 {
+		t.Fatalf("got %v records", len(transactionList))
+	}
+
+	create2 := transactionList[0]
+	if create2.InternalIndex != "0_0" || create2.OpCode != "CREATE2" || create2.Value.Int64() != 5 ||
+		create2.ContractAddress != common.HexToAddress("0xc1").String() || create2.From != common.HexToAddress("0xf0").String() ||
+		create2.Status != TransactionStatusSuccess || create2.CodeHash != crypto.Keccak256Hash([]byte{0x60, 0x01}).String() {
+		t.Fatalf("got %+v", create2)
+	}
+	if len(create2.CallPath) != 2 || create2.CallPath[0] != parent.From {
+		t.Fatalf("got call path %v", create2.CallPath)
+	}
+
+	nested := transactionList[1]
+	if nested.InternalIndex != "0_0_0" || nested.From != common.HexToAddress("0xc1").String() || len(nested.CallPath) != 3 {
+		t.Fatalf("got %+v", nested)
+	}
+
+	//外层调用回滚, 内层创建也失败
+	reverted := transactionList[2]
+	if reverted.Status != TransactionStatusFailed || reverted.CodeHash != "" {
+		t.Fatalf("got %+v", reverted)
+	}
+
+	//没有trace时只有交易本身的创建
+	parent.ContractAddress = common.HexToAddress("0xc4").String()
+	transactionList = parseContractCreations(parent, nil, true)
+	if len(transactionList) != 1 || transactionList[0].ContractAddress != parent.ContractAddress || transactionList[0].InternalIndex != InternalIndexDefault ||
+		transactionList[0].SubIndex != SubIndexContractCreation {
+		t.Fatalf("got %v", transactionList)
+	}
+}
+
+func TestContractRegistry(t *testing.T) {
+	registry := NewContractRegistry(rawdb.NewMemoryDatabase())
+	trace := &callFrame{}
+	json.Unmarshal([]byte(contractCreationTrace), trace)
+	parent := Transaction{
+		BlockNumber: *big.NewInt(100),
+		BlockHash:   "0x100",
+		Hash:        "0x01",
+		From:        common.HexToAddress("0x0a").String(),
+		Status:      TransactionStatusSuccess,
+	}
+	transactionList := parseContractCreations(parent, trace, false)
+	registry.Apply(transactionList)
+
+	contract, ok := registry.Get(common.HexToAddress("0xc2").String())
+	if !ok || contract.Creator != common.HexToAddress("0xc1").String() || contract.BlockNumber != 100 || contract.Hash != "0x01" {
+		t.Fatalf("got %+v", contract)
+	}
+	if _, ok := registry.Get(common.HexToAddress("0xc3").String()); ok {
+		t.Fatal("reverted creation registered")
+	}
+
+	//其他分叉的区块不会删掉
+	forked := make([]Transaction, len(transactionList))
+	copy(forked, transactionList)
+	for i := range forked {
+		forked[i].BlockHash = "0x100f"
+	}
+	registry.Retract(forked)
+	if _, ok := registry.Get(common.HexToAddress("0xc2").String()); !ok {
+		t.Fatal("contract retracted by another fork")
+	}
+	registry.Retract(transactionList)
+	if _, ok := registry.Get(common.HexToAddress("0xc2").String()); ok {
+		t.Fatal("contract not retracted")
+	}
+}
+
+func TestContractRegistrySelfDestruct(t *testing.T) {
+	registry := NewContractRegistry(rawdb.NewMemoryDatabase())
+	contractAddress := common.HexToAddress("0xc1").String()
+	creation := Transaction{
+		BlockNumber:     *big.NewInt(100),
+		BlockHash:       "0x100",
+		Hash:            "0x01",
+		From:            common.HexToAddress("0x0a").String(),
+		ContractAddress: contractAddress,
+		TokenType:       TokenTypeContractCreation,
+		Status:          TransactionStatusSuccess,
+	}
+	selfDestruct := Transaction{
+		BlockNumber:     *big.NewInt(105),
+		BlockHash:       "0x105",
+		Hash:            "0x02",
+		From:            contractAddress,
+		To:              common.HexToAddress("0xb1").String(),
+		ContractAddress: contractAddress,
+		OpCode:          OpCodeSelfDestruct,
+		Status:          TransactionStatusSuccess,
+	}
+	registry.Apply([]Transaction{creation})
+	registry.Apply([]Transaction{selfDestruct})
+	contract, _ := registry.Get(contractAddress)
+	if !contract.Destroyed || contract.Beneficiary != selfDestruct.To || contract.DestroyedBlockNumber != 105 {
+		t.Fatalf("got %+v", contract)
+	}
+
+	//重新导出创建的区块不会清掉自毁
+	registry.Apply([]Transaction{creation})
+	if contract, _ = registry.Get(contractAddress); !contract.Destroyed {
+		t.Fatalf("got %+v", contract)
+	}
+
+	registry.Retract([]Transaction{selfDestruct})
+	if contract, _ = registry.Get(contractAddress); contract.Destroyed || contract.Hash != "0x01" {
+		t.Fatalf("got %+v", contract)
+	}
+}
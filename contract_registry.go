@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var contractPrefix = []byte("contract-")
+
+// Contract is a contract created by an exported block.
+type Contract struct {
+	Address              string   `json:"address"`
+	Creator              string   `json:"creator"`
+	CallPath             []string `json:"call_path"` // 从交易发起者到创建者的调用路径
+	CodeHash             string   `json:"code_hash"`
+	BlockNumber          uint64   `json:"block_number"`
+	BlockHash            string   `json:"block_hash"`
+	Hash                 string   `json:"hash"` // 创建合约的交易
+	TransactionIndex     uint64   `json:"transaction_index"`
+	Destroyed            bool     `json:"destroyed"`
+	Beneficiary          string   `json:"beneficiary"` // 自毁时接收余额的地址
+	DestroyedBlockNumber uint64   `json:"destroyed_block_number"`
+	DestroyedBlockHash   string   `json:"destroyed_block_hash"`
+	DestroyedHash        string   `json:"destroyed_hash"` // 自毁的交易
+}
+
+// after tells whether a record of a block is not earlier than the creation of
+// the contract.
+func (s *Contract) after(transaction *Transaction) bool {
+	blockNumber := transaction.BlockNumber.Uint64()
+	return blockNumber > s.BlockNumber || blockNumber == s.BlockNumber && transaction.TransactionIndex.Uint64() >= s.TransactionIndex
+}
+
+// ContractRegistry keeps the contracts created by the exported blocks, keyed
+// by address.
+type ContractRegistry struct {
+	db   ethdb.Database
+	lock sync.Mutex
+}
+
+func NewContractRegistry(db ethdb.Database) *ContractRegistry {
+	return &ContractRegistry{db: db}
+}
+
+func contractKey(address string) []byte {
+	return []byte(fmt.Sprintf("%s%s", contractPrefix, normalizeAddress(address)))
+}
+
+func isContractCreation(transaction *Transaction) bool {
+	return transaction.TokenType == TokenTypeContractCreation && transaction.Status == TransactionStatusSuccess &&
+		transaction.ContractAddress != "" && !transaction.Removed
+}
+
+func isSelfDestruct(transaction *Transaction) bool {
+	return transaction.OpCode == OpCodeSelfDestruct && transaction.Status == TransactionStatusSuccess &&
+		transaction.ContractAddress != "" && !transaction.Removed
+}
+
+func (s *ContractRegistry) get(address string) (*Contract, error) {
+	data, err := s.db.Get(contractKey(address))
+	if err != nil {
+		return nil, err
+	}
+	contract := &Contract{}
+	if err := json.Unmarshal(data, contract); err != nil {
+		return nil, err
+	}
+	return contract, nil
+}
+
+func (s *ContractRegistry) put(contract *Contract) {
+	marshal, err := json.Marshal(contract)
+	if err != nil {
+		return
+	}
+	if err := s.db.Put(contractKey(contract.Address), marshal); err != nil {
+		log.Errorf("put contract %v error %v", contract.Address, err)
+	}
+}
+
+// Apply records the contracts created and destroyed among the records of a
+// block, which are in execution order. A contract created later than a record
+// is kept, so blocks may be applied out of order.
+func (s *ContractRegistry) Apply(transactionList []Transaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		if isContractCreation(transaction) {
+			contract, err := s.get(transaction.ContractAddress)
+			if err == nil && (contract.Hash == transaction.Hash || !contract.after(transaction)) {
+				continue
+			}
+			s.put(&Contract{
+				Address:          normalizeAddress(transaction.ContractAddress),
+				Creator:          transaction.From,
+				CallPath:         transaction.CallPath,
+				CodeHash:         transaction.CodeHash,
+				BlockNumber:      transaction.BlockNumber.Uint64(),
+				BlockHash:        transaction.BlockHash,
+				Hash:             transaction.Hash,
+				TransactionIndex: transaction.TransactionIndex.Uint64(),
+			})
+		} else if isSelfDestruct(transaction) {
+			//只标记已知的合约
+			contract, err := s.get(transaction.ContractAddress)
+			if err != nil || contract.Destroyed || !contract.after(transaction) {
+				continue
+			}
+			contract.Destroyed = true
+			contract.Beneficiary = normalizeAddress(transaction.To)
+			contract.DestroyedBlockNumber = transaction.BlockNumber.Uint64()
+			contract.DestroyedBlockHash = transaction.BlockHash
+			contract.DestroyedHash = transaction.Hash
+			s.put(contract)
+		}
+	}
+}
+
+// Retract undoes the creations and destructions of a block that was reorged
+// out, in reverse order.
+func (s *ContractRegistry) Retract(transactionList []Transaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := len(transactionList) - 1; i >= 0; i-- {
+		transaction := &transactionList[i]
+		if isContractCreation(transaction) {
+			contract, err := s.get(transaction.ContractAddress)
+			if err != nil || contract.BlockHash != transaction.BlockHash {
+				continue
+			}
+			if err := s.db.Delete(contractKey(contract.Address)); err != nil {
+				log.Errorf("delete contract %v error %v", contract.Address, err)
+			}
+		} else if isSelfDestruct(transaction) {
+			contract, err := s.get(transaction.ContractAddress)
+			if err != nil || !contract.Destroyed || contract.DestroyedBlockHash != transaction.BlockHash {
+				continue
+			}
+			contract.Destroyed = false
+			contract.Beneficiary = ""
+			contract.DestroyedBlockNumber = 0
+			contract.DestroyedBlockHash = ""
+			contract.DestroyedHash = ""
+			s.put(contract)
+		}
+	}
+}
+
+// Get returns the contract created at an address.
+func (s *ContractRegistry) Get(address string) (*Contract, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	contract, err := s.get(address)
+	if err != nil {
+		return nil, false
+	}
+	return contract, true
+}
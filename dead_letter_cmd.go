@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	deadLetterSinkFlag = cli.StringFlag{
+		Name:  "sink",
+		Usage: "Only the dead letters of this sink (http endpoint or saver name)",
+	}
+
+	deadLetterFlags = append([]cli.Flag{deadLetterSinkFlag}, nodeFlags...)
+
+	deadLetterCommand = cli.Command{
+		Name:     "deadletter",
+		Usage:    "Manage the batches that failed to save",
+		Category: "MISCELLANEOUS COMMANDS",
+		Description: `
+The batches a saver failed to save are kept in the etherquery database of the
+datadir and retried by the running service. These commands work on a stopped
+node, use the etherquery_deadLetters RPC methods on a running one.`,
+		Subcommands: []cli.Command{
+			{
+				Action:    utils.MigrateFlags(listDeadLetters),
+				Name:      "list",
+				Usage:     "List the dead letters",
+				ArgsUsage: "",
+				Flags:     deadLetterFlags,
+			},
+			{
+				Action:    utils.MigrateFlags(replayDeadLetters),
+				Name:      "replay",
+				Usage:     "Save the dead letters again to the sink they failed on",
+				ArgsUsage: "",
+				Flags:     deadLetterFlags,
+			},
+			{
+				Action:    utils.MigrateFlags(purgeDeadLetters),
+				Name:      "purge",
+				Usage:     "Drop the dead letters",
+				ArgsUsage: "",
+				Flags:     deadLetterFlags,
+			},
+		},
+	}
+)
+
+// withDeadLetterQueue opens the etherquery database of the datadir.
+func withDeadLetterQueue(ctx *cli.Context, f func(deadLetterQueue *DeadLetterQueue) error) error {
+	appConfig, err := loadAppConfig("config.yml")
+	if err != nil {
+		return err
+	}
+	//只打开 etherquery 数据库, 不启动节点
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+	db, err := stack.OpenDatabase("etherquery", 16, 16, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return f(NewDeadLetterQueue(appConfig, db, NewSaver(appConfig)))
+}
+
+func listDeadLetters(ctx *cli.Context) error {
+	return withDeadLetterQueue(ctx, func(deadLetterQueue *DeadLetterQueue) error {
+		for _, deadLetter := range deadLetterQueue.List(ctx.String(deadLetterSinkFlag.Name)) {
+			marshal, _ := json.Marshal(deadLetter)
+			fmt.Println(string(marshal))
+		}
+		return nil
+	})
+}
+
+func replayDeadLetters(ctx *cli.Context) error {
+	return withDeadLetterQueue(ctx, func(deadLetterQueue *DeadLetterQueue) error {
+		fmt.Println("replayed", deadLetterQueue.Replay(ctx.String(deadLetterSinkFlag.Name), true))
+		return nil
+	})
+}
+
+func purgeDeadLetters(ctx *cli.Context) error {
+	return withDeadLetterQueue(ctx, func(deadLetterQueue *DeadLetterQueue) error {
+		fmt.Println("purged", deadLetterQueue.Purge(ctx.String(deadLetterSinkFlag.Name)))
+		return nil
+	})
+}
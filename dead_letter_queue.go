@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var deadLetterPrefix = []byte("deadLetter-")
+
+// DeadLetter is a batch of records a sink failed to save.
+type DeadLetter struct {
+	Key             string        `json:"key"`
+	Sink            string        `json:"sink"`
+	BlockNumber     uint64        `json:"block_number"`
+	Err             string        `json:"err"`
+	Attempts        uint64        `json:"attempts"`
+	CreateTime      int64         `json:"create_time"`
+	NextAttemptTime int64         `json:"next_attempt_time"`
+	Size            int           `json:"size"`
+	TransactionList []Transaction `json:"transaction_list,omitempty"`
+}
+
+// DeadLetterQueue persists the batches that failed to save in the database,
+// keyed by sink and block, and replays them to the sink they failed on.
+type DeadLetterQueue struct {
+	appConfig        *AppConfig
+	db               ethdb.Database
+	saver            Saver
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	lock             sync.Mutex // 重放和清理互斥
+}
+
+func NewDeadLetterQueue(appConfig *AppConfig, db ethdb.Database, saver Saver) *DeadLetterQueue {
+	retryInterval, err := time.ParseDuration(appConfig.DeadLetterRetryInterval)
+	if err != nil || retryInterval <= 0 {
+		retryInterval = 10 * time.Second
+	}
+	maxRetryInterval, err := time.ParseDuration(appConfig.DeadLetterMaxRetryInterval)
+	if err != nil || maxRetryInterval < retryInterval {
+		maxRetryInterval = time.Hour
+	}
+	return &DeadLetterQueue{
+		appConfig:        appConfig,
+		db:               db,
+		saver:            saver,
+		retryInterval:    retryInterval,
+		maxRetryInterval: maxRetryInterval,
+	}
+}
+
+func deadLetterSinkPrefix(sink string) []byte {
+	if sink == "" {
+		return deadLetterPrefix
+	}
+	return []byte(fmt.Sprintf("%s%s-", deadLetterPrefix, sink))
+}
+
+// Put persists the records of the failed sinks of a save error. The call
+// trees and receipts are kept for the sinks in tree format only.
+func (s *DeadLetterQueue) Put(blockNumber uint64, err error) {
+	saveError, ok := err.(SaveError)
+	if !ok {
+		log.Errorf("block %v save error %v can not be queued as dead letter", blockNumber, err)
+		return
+	}
+	now := time.Now()
+	for _, sinkError := range saveError {
+		if len(sinkError.TransactionList) == 0 {
+			log.Errorf("block %v save error %v has no records to queue as dead letter", blockNumber, sinkError)
+			continue
+		}
+		transactionList := sinkError.TransactionList
+		if s.appConfig.GetSinkFormat(sinkError.Sink) != SinkFormatTree {
+			//只有 tree 格式需要调用树和receipt, 重放时区块的状态不一定还能重新 trace
+			transactionList = stripCallTreeList(transactionList)
+		}
+		deadLetter := &DeadLetter{
+			Key:             fmt.Sprintf("%s%020d-%d", deadLetterSinkPrefix(sinkError.Sink), blockNumber, now.UnixNano()),
+			Sink:            sinkError.Sink,
+			BlockNumber:     blockNumber,
+			Err:             sinkError.Err.Error(),
+			CreateTime:      now.Unix(),
+			NextAttemptTime: now.Add(s.retryInterval).Unix(),
+			Size:            len(sinkError.TransactionList),
+			TransactionList: transactionList,
+		}
+		if err := s.put(deadLetter); err != nil {
+			log.Errorf("put dead letter %v error %v", deadLetter.Key, err)
+			continue
+		}
+		log.Warnf("block %v %v records queued as dead letter of sink %v", blockNumber, deadLetter.Size, sinkError.Sink)
+	}
+}
+
+func (s *DeadLetterQueue) put(deadLetter *DeadLetter) error {
+	marshal, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(deadLetter.Key), marshal)
+}
+
+func (s *DeadLetterQueue) iterate(sink string, f func(deadLetter *DeadLetter) bool) {
+	it := s.db.NewIterator(deadLetterSinkPrefix(sink), nil)
+	defer it.Release()
+	for it.Next() {
+		deadLetter := &DeadLetter{}
+		if err := json.Unmarshal(it.Value(), deadLetter); err != nil {
+			log.Errorf("unmarshal dead letter %v error %v", string(it.Key()), err)
+			continue
+		}
+		if sink != "" && deadLetter.Sink != sink {
+			continue
+		}
+		if !f(deadLetter) {
+			return
+		}
+	}
+}
+
+// List returns the dead letters of a sink, or of every sink when sink is
+// empty, without their records.
+func (s *DeadLetterQueue) List(sink string) []*DeadLetter {
+	deadLetterList := []*DeadLetter{}
+	s.iterate(sink, func(deadLetter *DeadLetter) bool {
+		deadLetter.TransactionList = nil
+		deadLetterList = append(deadLetterList, deadLetter)
+		return true
+	})
+	return deadLetterList
+}
+
+// Replay saves the dead letters of a sink again and removes the ones that
+// succeeded. Unless force is set, only the letters whose backoff elapsed are
+// tried. It returns the number of letters replayed.
+func (s *DeadLetterQueue) Replay(sink string, force bool) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var deadLetterList []*DeadLetter
+	now := time.Now()
+	s.iterate(sink, func(deadLetter *DeadLetter) bool {
+		if force || deadLetter.NextAttemptTime <= now.Unix() {
+			deadLetterList = append(deadLetterList, deadLetter)
+		}
+		return true
+	})
+
+	replayed := 0
+	for _, deadLetter := range deadLetterList {
+		if _, err := SaveToSink(s.saver, deadLetter.Sink, deadLetter.TransactionList); err != nil {
+			if sinkError, ok := err.(*SinkError); ok {
+				//只保留仍然失败的部分
+				deadLetter.TransactionList = sinkError.TransactionList
+				deadLetter.Size = len(sinkError.TransactionList)
+			}
+			deadLetter.Attempts++
+			deadLetter.Err = err.Error()
+			deadLetter.NextAttemptTime = now.Add(s.backoff(deadLetter.Attempts)).Unix()
+			if err := s.put(deadLetter); err != nil {
+				log.Errorf("update dead letter %v error %v", deadLetter.Key, err)
+			}
+			log.Warnf("replay dead letter %v attempt %v error %v", deadLetter.Key, deadLetter.Attempts, err)
+			continue
+		}
+		if err := s.db.Delete([]byte(deadLetter.Key)); err != nil {
+			log.Errorf("delete dead letter %v error %v", deadLetter.Key, err)
+		}
+		log.Infof("replay dead letter %v of block %v succeeded", deadLetter.Key, deadLetter.BlockNumber)
+		replayed++
+	}
+	return replayed
+}
+
+// backoff doubles the retry interval per failed attempt, up to the maximum.
+func (s *DeadLetterQueue) backoff(attempts uint64) time.Duration {
+	interval := s.retryInterval
+	for i := uint64(0); i < attempts && interval < s.maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > s.maxRetryInterval {
+		interval = s.maxRetryInterval
+	}
+	return interval
+}
+
+// Purge drops the dead letters of a sink, or of every sink when sink is empty.
+func (s *DeadLetterQueue) Purge(sink string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var keyList []string
+	s.iterate(sink, func(deadLetter *DeadLetter) bool {
+		keyList = append(keyList, deadLetter.Key)
+		return true
+	})
+	for _, key := range keyList {
+		if err := s.db.Delete([]byte(key)); err != nil {
+			log.Errorf("delete dead letter %v error %v", key, err)
+		}
+	}
+	return len(keyList)
+}
+
+// Run replays the dead letters in the background until ctx is done.
+func (s *DeadLetterQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Replay("", false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
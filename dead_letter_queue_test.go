@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type failingSaver struct {
+	fail  bool
+	saved map[string]int
+}
+
+func (s *failingSaver) SaveTransactionList(transactionList []Transaction) (int64, error) {
+	return s.SaveToSink("default", transactionList)
+}
+
+func (s *failingSaver) SaveToSink(sink string, transactionList []Transaction) (int64, error) {
+	if s.fail {
+		return 0, &SinkError{Sink: sink, TransactionList: transactionList, Err: errors.New("down")}
+	}
+	s.saved[sink] += len(transactionList)
+	return int64(len(transactionList)), nil
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	saver := &failingSaver{fail: true, saved: map[string]int{}}
+	deadLetterQueue := NewDeadLetterQueue(&AppConfig{}, rawdb.NewMemoryDatabase(), saver)
+	deadLetterQueue.Put(100, SaveError{
+		{Sink: "http://a", TransactionList: []Transaction{{Hash: "0x01"}, {Hash: "0x02"}}, Err: errors.New("down")},
+		{Sink: "http://b", TransactionList: []Transaction{{Hash: "0x01"}}, Err: errors.New("down")},
+	})
+	if deadLetterList := deadLetterQueue.List(""); len(deadLetterList) != 2 {
+		t.Fatalf("got %v dead letters, want 2", len(deadLetterList))
+	}
+
+	if replayed := deadLetterQueue.Replay("http://a", true); replayed != 0 {
+		t.Fatalf("replayed %v while the sink is down", replayed)
+	}
+	if deadLetter := deadLetterQueue.List("http://a")[0]; deadLetter.Attempts != 1 {
+		t.Fatalf("attempts %v, want 1", deadLetter.Attempts)
+	}
+
+	saver.fail = false
+	if replayed := deadLetterQueue.Replay("http://a", true); replayed != 1 || saver.saved["http://a"] != 2 || saver.saved["http://b"] != 0 {
+		t.Fatalf("replayed %v saved %v", replayed, saver.saved)
+	}
+	if purged := deadLetterQueue.Purge(""); purged != 1 {
+		t.Fatalf("purged %v, want 1", purged)
+	}
+}
+
+func TestDeadLetterBackoff(t *testing.T) {
+	deadLetterQueue := NewDeadLetterQueue(&AppConfig{DeadLetterRetryInterval: "1s", DeadLetterMaxRetryInterval: "5s"}, rawdb.NewMemoryDatabase(), nil)
+	for attempts, want := range []string{"1s", "2s", "4s", "5s", "5s"} {
+		if got := deadLetterQueue.backoff(uint64(attempts)).String(); got != want {
+			t.Errorf("attempts %v backoff %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestDeadLetterCallTree(t *testing.T) {
+	saver := &failingSaver{fail: true, saved: map[string]int{}}
+	appConfig := &AppConfig{SinkFormat: map[string]string{"http://a": SinkFormatTree}}
+	deadLetterQueue := NewDeadLetterQueue(appConfig, rawdb.NewMemoryDatabase(), saver)
+	transaction := Transaction{
+		Hash:          "0x01",
+		InternalIndex: InternalIndexDefault,
+		CallTree:      &CallTreeNode{InternalIndex: InternalIndexDefault, Type: "CALL"},
+		Receipt:       &types.Receipt{Status: types.ReceiptStatusSuccessful, Logs: []*types.Log{}},
+	}
+	deadLetterQueue.Put(100, SaveError{
+		{Sink: "http://a", TransactionList: []Transaction{transaction}, Err: errors.New("down")},
+		{Sink: "http://b", TransactionList: []Transaction{transaction}, Err: errors.New("down")},
+	})
+
+	//tree 格式的 sink 重放时仍然有调用树和receipt
+	treeList := map[string]bool{}
+	deadLetterQueue.iterate("", func(deadLetter *DeadLetter) bool {
+		if len(deadLetter.TransactionList) != 1 {
+			t.Fatalf("got %+v", deadLetter)
+		}
+		tree := deadLetter.TransactionList[0]
+		treeList[deadLetter.Sink] = tree.CallTree != nil && tree.Receipt != nil && tree.Receipt.Status == types.ReceiptStatusSuccessful
+		return true
+	})
+	if !treeList["http://a"] || treeList["http://b"] {
+		t.Fatalf("got %v", treeList)
+	}
+}
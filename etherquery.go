@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	log "github.com/cihub/seelog"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
-	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -22,12 +27,30 @@ import (
 type EtherQuery struct {
 	appConfig           *AppConfig
 	exporter            *TransactionExporter
+	migrations          []Migration // 按配置生成过滤条件的迁移
 	customDatabase      ethdb.Database
+	journal             *BlockJournal
+	allowances          *AllowanceStore
+	contracts           *ContractRegistry
+	deadLetterQueue     *DeadLetterQueue
+	retraceQueue        *RetraceQueue
+	watermark           *BlockWatermark
 	ethereum            *eth.Ethereum
+	blocks              chan *types.Block
+	unsafeBlocks        chan *types.Block
+	txs                 chan *types.Transaction
+	logs                chan *types.Log
+	queuedBlock         uint64 // 下一个要放入blocks的区块号
+	reexporting         int32
 	chainHeadEventSub   event.Subscription
+	chainSideEventSub   event.Subscription
 	newTxEventSub       event.Subscription
 	removedLogsEventSub event.Subscription
 	server              *p2p.Server
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	wg                  sync.WaitGroup // consumeBlocks和重新导出
+	workers             sync.WaitGroup // consumeBlocks启动的处理协程
 }
 
 func NewEtherQuery(appConfig *AppConfig, ctx *node.ServiceContext) (node.Service, error) {
@@ -40,11 +63,26 @@ func NewEtherQuery(appConfig *AppConfig, ctx *node.ServiceContext) (node.Service
 	if err != nil {
 		return nil, err
 	}
-	exporter := NewTransactionExporter(appConfig, ethereum)
+	saver := NewSaver(appConfig)
+	//在构造时创建, Start 之前调用的 RPC 也可以使用
+	serviceCtx, cancel := context.WithCancel(context.Background())
+	exporter := NewTransactionExporter(appConfig, ethereum.BlockChain(), ethereum.ChainDb(), saver, db)
 	return &EtherQuery{
 		appConfig:         appConfig,
 		exporter:          exporter,
+		migrations:        configureMigrations(Migrations, appConfig),
+		blocks:            make(chan *types.Block, appConfig.BlocksChannelSize),
+		unsafeBlocks:      make(chan *types.Block, appConfig.BlocksChannelSize),
+		txs:               make(chan *types.Transaction, appConfig.TxsChannelSize),
+		logs:              make(chan *types.Log, appConfig.LogsChannelSize),
 		customDatabase:    db,
+		journal:           NewBlockJournal(db, appConfig.ReorgDepth),
+		allowances:        NewAllowanceStore(db, appConfig.ReorgDepth, exporter.tokenMetadata.Allowance),
+		contracts:         NewContractRegistry(db),
+		deadLetterQueue:   NewDeadLetterQueue(appConfig, db, saver),
+		retraceQueue:      exporter.retraceQueue,
+		ctx:               serviceCtx,
+		cancel:            cancel,
 		ethereum:          ethereum,
 		chainHeadEventSub: nil,
 		newTxEventSub:     nil,
@@ -57,7 +95,67 @@ func (s *EtherQuery) Protocols() []p2p.Protocol {
 }
 
 func (s *EtherQuery) APIs() []rpc.API {
-	return []rpc.API{}
+	return []rpc.API{
+		{
+			Namespace: "etherquery",
+			Version:   "1.0",
+			Service:   NewPublicEtherQueryAPI(s),
+			Public:    true,
+		},
+		{
+			Namespace: "etherquery",
+			Version:   "1.0",
+			Service:   NewPrivateEtherQueryAPI(s),
+			Public:    false,
+		},
+	}
+}
+
+func (s *EtherQuery) getQueuedBlock() uint64 {
+	return atomic.LoadUint64(&s.queuedBlock)
+}
+
+// reexport exports an already exported block range again in the background.
+// The checkpoint is left untouched.
+func (s *EtherQuery) reexport(from uint64, to uint64) (uint64, error) {
+	if from > to {
+		return 0, fmt.Errorf("invalid block range %v-%v", from, to)
+	}
+	lastBlock, err := s.getInt("lastBlock")
+	if err != nil {
+		return 0, err
+	}
+	if to >= lastBlock {
+		return 0, fmt.Errorf("block %v is not exported yet, last block %v", to, lastBlock)
+	}
+	if !atomic.CompareAndSwapInt32(&s.reexporting, 0, 1) {
+		return 0, errors.New("reexport already running")
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer atomic.StoreInt32(&s.reexporting, 0)
+		chain := s.ethereum.BlockChain()
+		for number := from; number <= to; number++ {
+			if s.ctx.Err() != nil {
+				log.Warnf("reexport stopped at block %v", number)
+				return
+			}
+			block := chain.GetBlockByNumber(number)
+			if block == nil {
+				log.Errorf("reexport block %v not found", number)
+				return
+			}
+			transactionList := s.exporter.BuildBlock(block)
+			effects, err := s.exporter.SaveTransactionList(transactionList)
+			if err != nil {
+				log.Errorf("reexport block %v error %v", number, err)
+				s.queueDeadLetters(number, err, transactionList)
+			}
+			log.Infof("reexport block %v effects %v", number, effects)
+		}
+	}()
+	return to - from + 1, nil
 }
 
 func (s *EtherQuery) processTxs(ch <-chan *types.Transaction) {
@@ -69,45 +167,199 @@ func (s *EtherQuery) processTxs(ch <-chan *types.Transaction) {
 	}
 }
 
+// processUnsafeBlocks exports the blocks above the confirmation depth, they
+// are neither checkpointed nor retracted on reorg. Failures are not queued as
+// dead letters, the confirmed export of the block supersedes them.
+func (s *EtherQuery) processUnsafeBlocks(ch <-chan *types.Block) {
+	for block := range ch {
+		if block == nil {
+			continue
+		}
+		transactionList := s.exporter.BuildUnsafeBlock(block)
+		effects, err := s.exporter.SaveTransactionList(transactionList)
+		if err != nil {
+			//重放可能覆盖已确认的记录, 或者带回已经回滚的区块
+			log.Errorf("export unsafe block %v error %v", block.Number().Uint64(), err)
+		}
+		log.Debugf("processing unsafe block %v effects %v", block.Number().Uint64(), effects)
+	}
+}
+
 func (s *EtherQuery) processLogs(ch <-chan *types.Log) {
 	for log1 := range ch {
 		if log1 == nil {
 			continue
 		}
-		s.exporter.ExportRemovedLogs(log1)
+		s.retractBlock(log1.BlockNumber, log1.BlockHash)
 	}
 }
 
+// retractBlock withdraws the records exported for a block that was reorged
+// out and queues the canonical block of the same height for export.
+func (s *EtherQuery) retractBlock(number uint64, hash common.Hash) {
+	chain := s.ethereum.BlockChain()
+	if chain.GetCanonicalHash(number) == hash {
+		return
+	}
+	transactionList, ok := s.journal.Remove(number, hash)
+	if !ok {
+		return
+	}
+	s.watermark.Forget(number)
+	s.allowances.Retract(transactionList)
+	s.contracts.Retract(transactionList)
+	effects, err := s.exporter.ExportRemovedTransactions(transactionList)
+	if err != nil {
+		log.Errorf("retract block %v %v error %v", number, hash.String(), err)
+		s.queueDeadLetters(number, err, transactionList)
+	}
+	log.Warnf("block %v %v reorged out, retract effects %v", number, hash.String(), effects)
+	if number >= s.getQueuedBlock() {
+		return
+	}
+	//区块已经从watermark中去掉, 必须重新放入, 否则之后的区块一直等待它
+	for {
+		if number > chain.CurrentBlock().NumberU64() {
+			//主链变短了, checkReorg 会降低 lastBlock, 主链长回来时重新放入
+			return
+		}
+		if block := chain.GetBlockByNumber(number); block != nil {
+			s.queueBlock(block)
+			return
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// queueBlock hands a block to the block workers, it gives up when the
+// service is stopping.
+func (s *EtherQuery) queueBlock(block *types.Block) bool {
+	select {
+	case s.blocks <- block:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// checkReorg compares the journal of recently exported blocks with the
+// canonical chain and retracts the blocks that were replaced. It returns the
+// next block to be queued.
+func (s *EtherQuery) checkReorg(head uint64, lastBlock uint64) uint64 {
+	chain := s.ethereum.BlockChain()
+	queuedBlock := lastBlock
+	if head+1 < lastBlock {
+		//新的head比已经导出的低, 高出的部分都已经不在主链上
+		lastBlock = head + 1
+		atomic.StoreUint64(&s.queuedBlock, lastBlock)
+	}
+	var from uint64 = 0
+	if queuedBlock > s.appConfig.ReorgDepth {
+		from = queuedBlock - s.appConfig.ReorgDepth
+	}
+	for number := from; number < queuedBlock; number++ {
+		hash, ok := s.journal.Hash(number)
+		if ok && hash != chain.GetCanonicalHash(number) {
+			s.retractBlock(number, hash)
+		}
+	}
+	return lastBlock
+}
+
 func (s *EtherQuery) processBlocks(index int64, ch <-chan *types.Block) {
 	for {
 		select {
+		case <-s.ctx.Done():
+			return
 		case block := <-ch:
 			if block == nil {
 				continue
 			}
+			if s.ctx.Err() != nil {
+				//停止时还没开始处理的区块不再处理, 它们在checkpoint之后, 重启后会重新导出
+				return
+			}
 			var effects int64 = 0
 			var startTime = time.Now().UnixNano()
+			var transactionList []Transaction
 			blockNumber := block.Number().Uint64()
 			if blockNumber >= s.appConfig.StartBlock {
-				if blockNumber == 0 {
-					root := s.ethereum.BlockChain().GetBlockByHash(block.Hash()).Root()
-					chainDb := s.ethereum.BlockChain().StateCache()
-					snapshot := s.ethereum.BlockChain().Snapshot()
-					stateDB, err := state.New(root, chainDb, snapshot)
-					if err != nil {
-						log.Errorf("Failed to get state DB for genesis Block: %v", err)
-					}
-					world := stateDB.RawDump(false, false, true)
-					effects, _ = s.exporter.ExportGenesisBlocks(block, world)
-				} else {
-					effects, _ = s.exporter.ExportBlock(block)
+				//创世区块的分配也在 BuildBlock 中导出
+				transactionList = s.exporter.BuildBlock(block)
+			}
+			//并发处理, 按区块顺序保存
+			if !s.watermark.WaitTurn(blockNumber) {
+				log.Infof("goroutine %v stopped before block %v was saved, it will be exported after restart", index, blockNumber)
+				return
+			}
+			if blockNumber >= s.appConfig.StartBlock {
+				var err error
+				effects, err = s.saveBlock(blockNumber, transactionList)
+				if err != nil {
+					//required sink还没有保存成功, 区块不算完成, 重启后会重新导出
+					log.Warnf("goroutine %v stopped before block %v was acknowledged, error %v", index, blockNumber, err)
+					return
+				}
+				if err := s.journal.Put(blockNumber, block.Hash(), transactionList); err != nil {
+					log.Errorf("journal block %v error %v", blockNumber, err)
 				}
+				s.allowances.Apply(transactionList)
+				s.contracts.Apply(transactionList)
 			}
 			log.Infof("goroutine %v processing block %v effects %v %vms @%v...", index, blockNumber, effects, (time.Now().UnixNano()-startTime)/10e6, time.Unix(int64(block.Time()), 0))
-			s.putLastBlock(blockNumber)
-		default:
-			time.Sleep(time.Millisecond * 10)
+			s.watermark.Complete(blockNumber)
+		}
+	}
+}
+
+// saveBlock saves the records of a block in the turn of its worker. Failures
+// of best-effort sinks are queued as dead letters and do not hold the
+// checkpoint. Failures of required sinks are retried with backoff until they
+// succeed, only an error of a required sink when the service stops is
+// returned.
+func (s *EtherQuery) saveBlock(blockNumber uint64, transactionList []Transaction) (int64, error) {
+	effects, err := s.exporter.SaveTransactionList(transactionList)
+	required, bestEffort := SplitSaveError(s.appConfig, err, transactionList)
+	if len(bestEffort) > 0 {
+		//失败的数据已经持久化, 由后台重试, 不阻塞checkpoint
+		log.Errorf("save block %v error %v", blockNumber, bestEffort)
+		s.deadLetterQueue.Put(blockNumber, bestEffort)
+	}
+	for attempts := uint64(0); len(required) > 0; attempts++ {
+		backoff := s.deadLetterQueue.backoff(attempts)
+		log.Errorf("save block %v to required sinks error %v, retry in %v", blockNumber, required, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return effects, required
+		}
+		var failed SaveError
+		for _, sinkError := range required {
+			count, err := s.exporter.SaveToSink(sinkError.Sink, sinkError.TransactionList)
+			effects += count
+			if err != nil {
+				if e, ok := err.(*SinkError); ok {
+					failed = append(failed, e)
+				} else {
+					failed = append(failed, &SinkError{Sink: sinkError.Sink, TransactionList: sinkError.TransactionList, Err: err})
+				}
+			}
 		}
+		required = failed
+	}
+	return effects, nil
+}
+
+// queueDeadLetters queues the failures of a write that does not hold the
+// checkpoint, required sinks included.
+func (s *EtherQuery) queueDeadLetters(blockNumber uint64, err error, transactionList []Transaction) {
+	required, bestEffort := SplitSaveError(s.appConfig, err, transactionList)
+	if saveError := append(required, bestEffort...); len(saveError) > 0 {
+		s.deadLetterQueue.Put(blockNumber, saveError)
 	}
 }
 
@@ -143,60 +395,117 @@ func (s *EtherQuery) getLastBlock() uint64 {
 		}
 		s.putInt("dataVersion", DataVersion)
 		s.putInt("lastBlock", 0)
-		return 0
-	}
-	if dataVersion < DataVersion {
-		log.Warn("Obsolete dataVersion")
-		s.putInt("dataVersion", DataVersion)
-		s.putInt("lastBlock", 0)
+		ClearBlockWatermark(s.customDatabase)
 		return 0
 	}
 	lastBlock, err := s.getInt("lastBlock")
 	if err != nil {
-		return 0
+		lastBlock = 0
+	}
+	if dataVersion < DataVersion {
+		jobList, ok := planMigrations(s.migrations, dataVersion, DataVersion, lastBlock, s.appConfig.StartBlock)
+		if !ok {
+			log.Warnf("Obsolete dataVersion %v, no migration to %v, export from block 0", dataVersion, DataVersion)
+			s.putInt("dataVersion", DataVersion)
+			s.putInt("lastBlock", 0)
+			ClearBlockWatermark(s.customDatabase)
+			clearMigrationJobs(s.customDatabase)
+			return 0
+		}
+		//已经导出的区块在后台迁移, lastBlock不变
+		for _, job := range jobList {
+			log.Warnf("dataVersion %v migration %v block %v-%v", DataVersion, job.Description, job.FromBlock, job.ToBlock)
+			if err := putMigrationJob(s.customDatabase, job); err != nil {
+				log.Errorf("put migration job %v error %v", job.Version, err)
+			}
+		}
+		//checkpoint之后提前完成的区块是旧版本导出的, 重新导出
+		ClearBlockWatermark(s.customDatabase)
+		s.putInt("dataVersion", DataVersion)
 	}
 	return lastBlock
 }
 
+// putLastBlock saves the checkpoint, which is the first block not exported yet.
 func (s *EtherQuery) putLastBlock(block uint64) {
-	s.putInt("lastBlock", block)
+	if err := s.putInt("lastBlock", block); err != nil {
+		log.Errorf("put last block %v error %v", block, err)
+	}
 }
 
 func (s *EtherQuery) consumeBlocks() {
+	lastBlock := s.getLastBlock()
+	log.Infof("last Block %v", lastBlock)
+	s.watermark = NewBlockWatermark(s.customDatabase, lastBlock, s.putLastBlock)
+
 	//可以跑多个
-	blocks := make(chan *types.Block, s.appConfig.BlocksChannelSize)
+	blocks := s.blocks
 	for i := 0; i < int(s.appConfig.BlocksGoroutineSize); i++ {
-		go s.processBlocks(int64(i), blocks)
+		s.goWorker(func(index int64) func() {
+			return func() { s.processBlocks(index, blocks) }
+		}(int64(i)))
 	}
 	//可以跑多个
-	txs := make(chan *types.Transaction, s.appConfig.TxsChannelSize)
-	go s.processTxs(txs)
+	txs := s.txs
+	s.goWorker(func() { s.processTxs(txs) })
 
-	logs := make(chan *types.Log, s.appConfig.TxsChannelSize)
-	go s.processLogs(logs)
+	logs := s.logs
+	s.goWorker(func() { s.processLogs(logs) })
 
-	go func() {
+	if s.appConfig.ConfirmationDepth > 0 {
+		s.goWorker(func() { s.processUnsafeBlocks(s.unsafeBlocks) })
+	}
+
+	s.goWorker(func() { s.deadLetterQueue.Run(s.ctx) })
+
+	s.goWorker(s.runMigrations)
+
+	s.goWorker(s.runRetraces)
+
+	s.goWorker(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
 		for {
-			log.Infof("blocks size %v, txs size %v", len(blocks), len(txs))
-			time.Sleep(time.Minute)
+			log.Infof("blocks size %v, txs size %v, logs size %v", len(blocks), len(txs), len(logs))
+			select {
+			case <-ticker.C:
+			case <-s.ctx.Done():
+				return
+			}
 		}
-	}()
-	defer close(blocks)
+	})
+	defer s.shutdown()
 
 	chain := s.ethereum.BlockChain()
-	lastBlock := s.getLastBlock()
-	log.Infof("last Block %v", lastBlock)
+	atomic.StoreUint64(&s.queuedBlock, lastBlock)
 	// First catch up
-	for lastBlock < chain.CurrentBlock().Number().Uint64() {
-		blocks <- chain.GetBlockByNumber(lastBlock)
+	for lastBlock+s.appConfig.ConfirmationDepth < chain.CurrentBlock().Number().Uint64() {
+		//重启前已经完成的区块不再导出
+		if !s.watermark.DoneAhead(lastBlock) {
+			block := chain.GetBlockByNumber(lastBlock)
+			if block == nil {
+				//reorg中区块暂时找不到, 不能跳过, 收到新的head后从这个区块继续
+				log.Warnf("block %v not found, retry on next head", lastBlock)
+				break
+			}
+			if !s.queueBlock(block) {
+				return
+			}
+		}
 		lastBlock += 1
+		atomic.StoreUint64(&s.queuedBlock, lastBlock)
 	}
 
 	log.Info("Caught up; subscribing to new blocks.")
+	unsafeBlock := lastBlock
 	var headCh = make(chan core.ChainHeadEvent, s.appConfig.ChainHeadEventChannelSize)
 	s.chainHeadEventSub = s.ethereum.BlockChain().SubscribeChainHeadEvent(headCh)
 	defer s.chainHeadEventSub.Unsubscribe()
 
+	var sideCh = make(chan core.ChainSideEvent, s.appConfig.ChainHeadEventChannelSize)
+	s.chainSideEventSub = s.ethereum.BlockChain().SubscribeChainSideEvent(sideCh)
+	defer s.chainSideEventSub.Unsubscribe()
+
 	txEventCh := make(chan core.NewTxsEvent, s.appConfig.NewTxsEventChannelSize)
 	s.newTxEventSub = s.ethereum.TxPool().SubscribeNewTxsEvent(txEventCh)
 	defer s.newTxEventSub.Unsubscribe()
@@ -212,31 +521,119 @@ HandleLoop:
 			block := v.Block
 			newBlock := block.Number().Uint64()
 			log.Infof("current Block %v", newBlock)
-			for ; lastBlock <= newBlock; lastBlock++ {
-				blocks <- chain.GetBlockByNumber(lastBlock)
+			lastBlock = s.checkReorg(newBlock, lastBlock)
+			unsafeBlock = s.queueUnsafeBlocks(block, lastBlock, unsafeBlock)
+			//只导出达到确认数的区块
+			for ; lastBlock+s.appConfig.ConfirmationDepth <= newBlock; lastBlock++ {
+				if !s.watermark.DoneAhead(lastBlock) {
+					block := chain.GetBlockByNumber(lastBlock)
+					if block == nil {
+						log.Warnf("block %v not found, retry on next head", lastBlock)
+						break
+					}
+					if !s.queueBlock(block) {
+						break HandleLoop
+					}
+				}
+				atomic.StoreUint64(&s.queuedBlock, lastBlock+1)
 			}
+		case v := <-sideCh:
+			block := v.Block
+			log.Infof("side Block %v %v", block.Number().Uint64(), block.Hash().String())
+			s.retractBlock(block.Number().Uint64(), block.Hash())
 		case v := <-txEventCh:
 			transactions := v.Txs
 			for _, tx := range transactions {
-				txs <- tx
+				select {
+				case txs <- tx:
+				case <-s.ctx.Done():
+					break HandleLoop
+				}
 			}
 		case v := <-removedLogsEventCh:
 			logList := v.Logs
 			for _, log1 := range logList {
-				logs <- log1
+				select {
+				case logs <- log1:
+				case <-s.ctx.Done():
+					break HandleLoop
+				}
 			}
 		case err := <-s.chainHeadEventSub.Err():
 			log.Errorf("chain head event receive error %v", err)
 			break HandleLoop
+		case err := <-s.chainSideEventSub.Err():
+			log.Errorf("chain side event receive error %v", err)
+			break HandleLoop
 		case err := <-s.newTxEventSub.Err():
 			log.Errorf("tx receive error %v", err)
 			break HandleLoop
 		case err := <-s.removedLogsEventSub.Err():
 			log.Errorf("removed logs receive error %v", err)
 			break HandleLoop
+		case <-s.ctx.Done():
+			break HandleLoop
 		}
 	}
+}
+
+func (s *EtherQuery) goWorker(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
+}
+
+// shutdown runs when consumeBlocks returns. It stops the intake, lets the
+// workers finish the block they hold and writes the final checkpoint. Blocks still queued are not lost, they are after the checkpoint
+// and exported again on the next start.
+func (s *EtherQuery) shutdown() {
+	s.cancel()
+	s.watermark.Close()
+	close(s.txs)
+	close(s.logs)
+	close(s.unsafeBlocks)
+	s.workers.Wait()
+
+	log.Infof("ether query workers stopped, %v queued blocks left for next start", len(s.blocks))
+	s.putLastBlock(s.watermark.Next())
+}
+
+// queueUnsafeBlocks hands the blocks that have not reached the confirmation
+// depth to the unsafe stream, including the new head itself. It returns the
+// next block to be exported as unsafe.
+func (s *EtherQuery) queueUnsafeBlocks(head *types.Block, lastBlock uint64, unsafeBlock uint64) uint64 {
+	if s.appConfig.ConfirmationDepth == 0 {
+		return unsafeBlock
+	}
+	newBlock := head.Number().Uint64()
+	depth := s.appConfig.ConfirmationDepth
+	//达到确认数的区块走正常流程
+	if newBlock+1 > depth && unsafeBlock < newBlock+1-depth {
+		unsafeBlock = newBlock + 1 - depth
+	}
+	if unsafeBlock < lastBlock {
+		unsafeBlock = lastBlock
+	}
+	chain := s.ethereum.BlockChain()
+	for ; unsafeBlock < newBlock; unsafeBlock++ {
+		s.queueUnsafeBlock(chain.GetBlockByNumber(unsafeBlock))
+	}
+	s.queueUnsafeBlock(head)
+	return newBlock + 1
+}
 
+func (s *EtherQuery) queueUnsafeBlock(block *types.Block) {
+	if block == nil {
+		return
+	}
+	select {
+	case s.unsafeBlocks <- block:
+	default:
+		//unsafe流尽力而为, 处理不过来时丢弃
+		log.Warnf("unsafe blocks channel full, drop block %v", block.Number().Uint64())
+	}
 }
 
 func (s *EtherQuery) Start(server *p2p.Server) error {
@@ -244,18 +641,32 @@ func (s *EtherQuery) Start(server *p2p.Server) error {
 
 	s.server = server
 
-	go s.consumeBlocks()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.consumeBlocks()
+	}()
 
 	return nil
 }
 
 func (s *EtherQuery) Stop() error {
 	log.Info("Stopping ether query service.")
+	s.cancel()
+	s.wg.Wait()
 	if s.chainHeadEventSub != nil {
 		s.chainHeadEventSub.Unsubscribe()
 	}
+	if s.chainSideEventSub != nil {
+		s.chainSideEventSub.Unsubscribe()
+	}
 	if s.newTxEventSub != nil {
 		s.newTxEventSub.Unsubscribe()
 	}
+	if s.removedLogsEventSub != nil {
+		s.removedLogsEventSub.Unsubscribe()
+	}
+	s.customDatabase.Close()
+	log.Info("Ether query service stopped.")
 	return nil
 }
@@ -0,0 +1,122 @@
+package main
+
+import "github.com/ethereum/go-ethereum/common"
+
+// PublicEtherQueryAPI exposes the state of the exporter under the etherquery
+// namespace.
+type PublicEtherQueryAPI struct {
+	s *EtherQuery
+}
+
+func NewPublicEtherQueryAPI(s *EtherQuery) *PublicEtherQueryAPI {
+	return &PublicEtherQueryAPI{s: s}
+}
+
+type ChannelStatus struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+type EtherQueryStatus struct {
+	LastBlock   uint64        `json:"last_block"`   // 第一个还没有导出的区块, 即lastBlock checkpoint
+	QueuedBlock uint64        `json:"queued_block"` // 下一个要放入blocks的区块
+	Head        uint64        `json:"head"`
+	Lag         uint64        `json:"lag"` // 还没有导出的区块数
+	Blocks      ChannelStatus `json:"blocks"`
+	Txs         ChannelStatus `json:"txs"`
+	Logs        ChannelStatus `json:"logs"`
+}
+
+// Status returns the checkpoint, the chain head and the fill levels of the
+// work channels.
+func (api *PublicEtherQueryAPI) Status() (*EtherQueryStatus, error) {
+	lastBlock, err := api.s.getInt("lastBlock")
+	if err != nil {
+		return nil, err
+	}
+	status := &EtherQueryStatus{
+		LastBlock:   lastBlock,
+		QueuedBlock: api.s.getQueuedBlock(),
+		Head:        api.s.ethereum.BlockChain().CurrentBlock().Number().Uint64(),
+		Blocks:      ChannelStatus{Len: len(api.s.blocks), Cap: cap(api.s.blocks)},
+		Txs:         ChannelStatus{Len: len(api.s.txs), Cap: cap(api.s.txs)},
+		Logs:        ChannelStatus{Len: len(api.s.logs), Cap: cap(api.s.logs)},
+	}
+	if status.Head+1 > lastBlock {
+		status.Lag = status.Head + 1 - lastBlock
+	}
+	return status, nil
+}
+
+// Config returns the running app config.
+func (api *PublicEtherQueryAPI) Config() *AppConfig {
+	return api.s.appConfig
+}
+
+// Migrations lists the unfinished data-version migrations and their progress.
+func (api *PublicEtherQueryAPI) Migrations() []*MigrationJob {
+	return loadMigrationJobs(api.s.customDatabase)
+}
+
+// Allowances lists the non-zero allowances given by an owner, of one token or
+// of all tokens, as set by the exported Approval events.
+func (api *PublicEtherQueryAPI) Allowances(owner common.Address, token *common.Address) []*Allowance {
+	var tokenAddress string
+	if token != nil {
+		tokenAddress = token.String()
+	}
+	return api.s.allowances.List(owner.String(), tokenAddress)
+}
+
+// Contract returns the creation of the contract at an address, null if no
+// exported block created it.
+func (api *PublicEtherQueryAPI) Contract(address common.Address) *Contract {
+	contract, _ := api.s.contracts.Get(address.String())
+	return contract
+}
+
+func sinkName(sink *string) string {
+	if sink == nil {
+		return ""
+	}
+	return *sink
+}
+
+// DeadLetters lists the batches that failed to save, of one sink or of all.
+func (api *PublicEtherQueryAPI) DeadLetters(sink *string) []*DeadLetter {
+	return api.s.deadLetterQueue.List(sinkName(sink))
+}
+
+// RetraceTasks lists the transactions whose trace timed out and that wait to
+// be traced again.
+func (api *PublicEtherQueryAPI) RetraceTasks() []*RetraceTask {
+	return api.s.retraceQueue.List()
+}
+
+// PrivateEtherQueryAPI exposes the methods that change the exported data or
+// the dead letters. It is not public: HTTP and WS serve it only when the
+// etherquery namespace is enabled explicitly, IPC always serves it.
+type PrivateEtherQueryAPI struct {
+	s *EtherQuery
+}
+
+func NewPrivateEtherQueryAPI(s *EtherQuery) *PrivateEtherQueryAPI {
+	return &PrivateEtherQueryAPI{s: s}
+}
+
+// Reexport exports the blocks from..to again in the background and returns
+// the number of blocks scheduled. The range must already be exported.
+func (api *PrivateEtherQueryAPI) Reexport(from uint64, to uint64) (uint64, error) {
+	return api.s.reexport(from, to)
+}
+
+// ReplayDeadLetters saves the dead letters again right away, ignoring their
+// backoff, and returns the number replayed.
+func (api *PrivateEtherQueryAPI) ReplayDeadLetters(sink *string) int {
+	return api.s.deadLetterQueue.Replay(sinkName(sink), true)
+}
+
+// PurgeDeadLetters drops the dead letters and returns the number dropped.
+func (api *PrivateEtherQueryAPI) PurgeDeadLetters(sink *string) int {
+	return api.s.deadLetterQueue.Purge(sinkName(sink))
+}
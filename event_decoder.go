@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// abiFile is an ABI JSON file of the abi directory. It is either a plain ABI
+// array, which decodes the events of every contract, or an object scoping the
+// ABI to some contracts:
+//
+//	{"addresses": ["0x..."], "abi": [...]}
+type abiFile struct {
+	Addresses []string        `json:"addresses"`
+	Abi       json.RawMessage `json:"abi"`
+}
+
+// EventDecoderRegistry decodes the logs of the events found in the ABI files.
+// Events scoped to a contract take precedence over global ones.
+type EventDecoderRegistry struct {
+	global map[common.Hash][]*abi.Event
+	scoped map[common.Address]map[common.Hash][]*abi.Event
+}
+
+func NewEventDecoderRegistry() *EventDecoderRegistry {
+	return &EventDecoderRegistry{
+		global: map[common.Hash][]*abi.Event{},
+		scoped: map[common.Address]map[common.Hash][]*abi.Event{},
+	}
+}
+
+// LoadEventDecoderRegistry loads every *.json file of the directory, an empty
+// directory name gives an empty registry. A file that can not be loaded is
+// logged and skipped.
+func LoadEventDecoderRegistry(dir string) (*EventDecoderRegistry, error) {
+	registry := NewEventDecoderRegistry()
+	if dir == "" {
+		return registry, nil
+	}
+	fileList, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range fileList {
+		//一个文件有错只跳过这个文件, 其他文件照常加载
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("skip abi %v, read error %v", file, err)
+			continue
+		}
+		if err := registry.Add(data); err != nil {
+			log.Errorf("skip abi %v, load error %v", file, err)
+			continue
+		}
+		log.Infof("load abi %v", file)
+	}
+	return registry, nil
+}
+
+// Add registers the events of an ABI file.
+func (s *EventDecoderRegistry) Add(data []byte) error {
+	file := abiFile{Abi: data}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+	}
+	contractAbi, err := abi.JSON(strings.NewReader(string(file.Abi)))
+	if err != nil {
+		return err
+	}
+	for _, event := range contractAbi.Events {
+		event := event
+		if event.Anonymous {
+			continue
+		}
+		//没有名字的参数用位置命名
+		for i := range event.Inputs {
+			if event.Inputs[i].Name == "" {
+				event.Inputs[i].Name = fmt.Sprintf("arg%d", i)
+			}
+		}
+		if len(file.Addresses) == 0 {
+			s.global[event.ID] = append(s.global[event.ID], &event)
+			continue
+		}
+		for _, address := range file.Addresses {
+			contract := common.HexToAddress(address)
+			if s.scoped[contract] == nil {
+				s.scoped[contract] = map[common.Hash][]*abi.Event{}
+			}
+			s.scoped[contract][event.ID] = append(s.scoped[contract][event.ID], &event)
+		}
+	}
+	return nil
+}
+
+// lookup returns the event of a log, the number of indexed arguments tells
+// apart events with the same signature such as ERC-20 and ERC-721 Transfer.
+func (s *EventDecoderRegistry) lookup(log1 *types.Log) *abi.Event {
+	for _, eventList := range [][]*abi.Event{s.scoped[log1.Address][log1.Topics[0]], s.global[log1.Topics[0]]} {
+		for _, event := range eventList {
+			indexed := 0
+			for _, input := range event.Inputs {
+				if input.Indexed {
+					indexed++
+				}
+			}
+			if indexed == len(log1.Topics)-1 {
+				return event
+			}
+		}
+	}
+	return nil
+}
+
+// Decode decodes a log into a TokenTypeEvent record with named arguments. It
+// returns false if no registered event matches.
+func (s *EventDecoderRegistry) Decode(transaction Transaction, log1 *types.Log) (Transaction, bool) {
+	if len(log1.Topics) == 0 {
+		return transaction, false
+	}
+	event := s.lookup(log1)
+	if event == nil {
+		return transaction, false
+	}
+	values := map[string]interface{}{}
+	var indexed abi.Arguments
+	for _, input := range event.Inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+	if err := abi.ParseTopicsIntoMap(values, indexed, log1.Topics[1:]); err != nil {
+		log.Debugf("decode topics of %v log %v error %v", transaction.Hash, log1.Index, err)
+		return transaction, false
+	}
+	if err := event.Inputs.NonIndexed().UnpackIntoMap(values, log1.Data); err != nil {
+		log.Debugf("decode data of %v log %v error %v", transaction.Hash, log1.Index, err)
+		return transaction, false
+	}
+	transaction.TokenType = TokenTypeEvent
+	transaction.EventName = event.Name
+	transaction.EventArgs = map[string]string{}
+	for name, value := range values {
+		transaction.EventArgs[name] = formatAbiValue(value)
+	}
+	return transaction, true
+}
+
+// formatAbiValue formats a decoded ABI value as a string: addresses in
+// checksum form, integers in decimal, bytes in hex and arrays as JSON arrays.
+func formatAbiValue(value interface{}) string {
+	switch v := value.(type) {
+	case common.Address:
+		return v.String()
+	case common.Hash:
+		return v.Hex()
+	case *big.Int:
+		return v.String()
+	case []byte:
+		return hexutil.Encode(v)
+	case string:
+		return v
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			//bytesN
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return hexutil.Encode(b)
+		}
+		fallthrough
+	case reflect.Slice:
+		elementList := make([]string, rv.Len())
+		for i := range elementList {
+			elementList[i] = formatAbiValue(rv.Index(i).Interface())
+		}
+		marshal, _ := json.Marshal(elementList)
+		return string(marshal)
+	}
+	return fmt.Sprint(value)
+}
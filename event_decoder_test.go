@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const swapAbi = `{"addresses": ["0x000000000000000000000000000000000000000c"], "abi": [
+	{"anonymous": false, "name": "Swap", "type": "event", "inputs": [
+		{"indexed": true, "name": "sender", "type": "address"},
+		{"indexed": false, "name": "amountIn", "type": "uint256"},
+		{"indexed": false, "name": "", "type": "uint256[]"}
+	]}
+]}`
+
+func TestEventDecoderRegistry(t *testing.T) {
+	registry := NewEventDecoderRegistry()
+	if err := registry.Add([]byte(swapAbi)); err != nil {
+		t.Fatal(err)
+	}
+	pair := common.HexToAddress("0x0c")
+	sender := common.HexToAddress("0x0a")
+	data, err := newTokenArguments("uint256", "uint256[]").Pack(big.NewInt(7), []*big.Int{big.NewInt(1), big.NewInt(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log1 := &types.Log{
+		Address: pair,
+		Topics:  []common.Hash{crypto.Keccak256Hash([]byte("Swap(address,uint256,uint256[])")), sender.Hash()},
+		Data:    data,
+		Index:   3,
+	}
+	exporter := &TransactionExporter{eventDecoders: registry}
+	transactionList := exporter.parseTokenEvents(Transaction{}, &types.Receipt{Logs: []*types.Log{log1}})
+	if len(transactionList) != 1 {
+		t.Fatalf("got %v records, want 1", len(transactionList))
+	}
+	event := transactionList[0]
+	if event.TokenType != TokenTypeEvent || event.EventName != "Swap" || event.LogIndex.Int64() != 3 ||
+		event.EventArgs["sender"] != sender.String() || event.EventArgs["amountIn"] != "7" || event.EventArgs["arg2"] != `["1","2"]` {
+		t.Fatalf("event got %v", event)
+	}
+
+	//只对指定的合约生效
+	log1.Address = sender
+	if transactionList := exporter.parseTokenEvents(Transaction{}, &types.Receipt{Logs: []*types.Log{log1}}); len(transactionList) != 0 {
+		t.Fatalf("decoded log of another contract %v", transactionList)
+	}
+}
+
+func TestLoadEventDecoderRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "abi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("[{"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "swap.json"), []byte(swapAbi), 0644)
+
+	//坏的文件不影响其他文件
+	registry, err := LoadEventDecoderRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.scoped[common.HexToAddress("0x0c")]) != 1 {
+		t.Fatalf("swap abi not loaded")
+	}
+}
+
+func TestEventDecoderRegistryNonStandardTransfer(t *testing.T) {
+	//只有 from 是 indexed 的 Transfer, 和标准事件的 topic 相同
+	registry := NewEventDecoderRegistry()
+	err := registry.Add([]byte(`{"addresses": ["0x000000000000000000000000000000000000000c"], "abi": [
+		{"anonymous": false, "name": "Transfer", "type": "event", "inputs": [
+			{"indexed": true, "name": "from", "type": "address"},
+			{"indexed": false, "name": "to", "type": "address"},
+			{"indexed": false, "name": "value", "type": "uint256"}
+		]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := common.HexToAddress("0x0a")
+	data, err := newTokenArguments("address", "uint256").Pack(common.HexToAddress("0x0b"), big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log1 := &types.Log{Address: common.HexToAddress("0x0c"), Topics: []common.Hash{transferEventTopic, from.Hash()}, Data: data}
+	exporter := &TransactionExporter{eventDecoders: registry}
+	transactionList := exporter.parseTokenEvents(Transaction{}, &types.Receipt{Logs: []*types.Log{log1}})
+	if len(transactionList) != 1 || transactionList[0].TokenType != TokenTypeEvent || transactionList[0].EventArgs["value"] != "7" {
+		t.Fatalf("got %v", transactionList)
+	}
+}
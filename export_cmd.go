@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	exportFromFlag = cli.Uint64Flag{
+		Name:  "from",
+		Usage: "First block to export",
+	}
+	exportToFlag = cli.Uint64Flag{
+		Name:  "to",
+		Usage: "Last block to export, defaults to the current head of the datadir",
+	}
+	exportSaverFlag = cli.StringFlag{
+		Name:  "saver",
+		Usage: "Saver to write to (dummy, http, mongo), overrides config.yml",
+	}
+
+	exportCommand = cli.Command{
+		Action:    utils.MigrateFlags(exportBlocks),
+		Name:      "export",
+		Usage:     "Export a block range from an existing datadir",
+		ArgsUsage: "",
+		Flags: append([]cli.Flag{
+			exportFromFlag,
+			exportToFlag,
+			exportSaverFlag,
+		}, nodeFlags...),
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The export command opens the chain database of an existing datadir without
+starting the node or the eth service, the way geth export does, and exports
+the blocks --from..--to to the configured saver. The lastBlock
+checkpoint of the running service is not touched, so it can be used to
+backfill or re-derive historical data. The export stops at the first block a
+required sink fails to save, failures of other sinks are only logged.`,
+	}
+)
+
+// exportBlocks is the export command.
+func exportBlocks(ctx *cli.Context) error {
+	appConfig, err := loadAppConfig("config.yml")
+	if err != nil {
+		return err
+	}
+	if saver := ctx.String(exportSaverFlag.Name); saver != "" {
+		appConfig.Saver = saver
+	}
+	marshal, _ := json.Marshal(appConfig)
+	log.Infof("app config %v", string(marshal))
+
+	//不启动节点和 eth 服务, 只读打开链数据库, 和 geth export 一样
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+	chain, chainDb := utils.MakeChain(ctx, stack, true)
+	defer chainDb.Close()
+
+	from := ctx.Uint64(exportFromFlag.Name)
+	to := chain.CurrentBlock().Number().Uint64()
+	if ctx.IsSet(exportToFlag.Name) {
+		to = ctx.Uint64(exportToFlag.Name)
+	}
+	if from > to {
+		return fmt.Errorf("invalid block range %v-%v, head %v", from, to, chain.CurrentBlock().Number().Uint64())
+	}
+
+	db, err := stack.OpenDatabase("etherquery", 16, 16, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	exporter := NewTransactionExporter(appConfig, chain, chainDb, NewSaver(appConfig), db)
+	log.Infof("export block %v-%v", from, to)
+	for number := from; number <= to; number++ {
+		block := chain.GetBlockByNumber(number)
+		if block == nil {
+			return fmt.Errorf("block %v not found", number)
+		}
+		var startTime = time.Now().UnixNano()
+		effects, err := exporter.ExportBlock(block)
+		required, bestEffort := SplitSaveError(appConfig, err, nil)
+		if len(required) > 0 {
+			return fmt.Errorf("export block %v error %v", number, required)
+		}
+		if len(bestEffort) > 0 {
+			log.Errorf("export block %v error %v", number, bestEffort)
+		}
+		log.Infof("export block %v effects %v %vms", number, effects, (time.Now().UnixNano()-startTime)/10e6)
+	}
+	return nil
+}
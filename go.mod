@@ -3,7 +3,6 @@ module github.com/tokenbankteam/etherquery
 go 1.13
 
 require (
-	github.com/Jeffail/gabs v1.4.0
 	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575
 	github.com/elastic/gosigar v0.8.1-0.20180330100440-37f05ff46ffa
 	github.com/elazarl/goproxy v0.0.0-20200426045556-49ad98f6dac1 // indirect
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/golang/snappy"
 	"github.com/parnurzeal/gorequest"
@@ -14,32 +15,66 @@ type HttpSaver struct {
 }
 
 func (s *HttpSaver) SaveTransactionList(transactionList []Transaction) (int64, error) {
-	var batchTransactionList []Transaction
+	var saveError SaveError
+	for _, endpoint := range s.appConfig.SubscribeEndpointList {
+		if _, err := s.SaveToSink(endpoint, transactionList); err != nil {
+			saveError = append(saveError, err.(*SinkError))
+		}
+	}
+	if len(saveError) > 0 {
+		return int64(len(transactionList)), saveError
+	}
+	return int64(len(transactionList)), nil
+}
+
+// SaveToSink posts the transaction list to a single endpoint in batches, in
+// the format of the endpoint. The records of the batches that failed are
+// returned in a *SinkError.
+func (s *HttpSaver) SaveToSink(endpoint string, transactionList []Transaction) (int64, error) {
+	var failedTransactionList []Transaction
+	var lastErr error
+	post := func(batchDocumentList []sinkDocument) {
+		documentList := make([]interface{}, len(batchDocumentList))
+		for i, document := range batchDocumentList {
+			documentList[i] = document.document
+		}
+		if _, err := s.PostDocumentList(endpoint, documentList); err != nil {
+			for _, document := range batchDocumentList {
+				failedTransactionList = append(failedTransactionList, document.transactionList...)
+			}
+			lastErr = err
+		}
+	}
+
+	var batchDocumentList []sinkDocument
 	var resize uint64 = s.appConfig.BatchSize
-	for _, transaction := range transactionList {
+	for _, document := range buildSinkDocuments(s.appConfig, endpoint, transactionList) {
 		if resize == 0 {
-			for _, endpoint := range s.appConfig.SubscribeEndpointList {
-				s.PostTransactionList(endpoint, batchTransactionList)
-			}
+			post(batchDocumentList)
 			//reset
-			batchTransactionList = nil
+			batchDocumentList = nil
 			resize = s.appConfig.BatchSize
 		}
 
-		batchTransactionList = append(batchTransactionList, transaction)
+		batchDocumentList = append(batchDocumentList, document)
 		resize--
 	}
-	//process transaction list left
-	if len(batchTransactionList) > 0 {
-		for _, endpoint := range s.appConfig.SubscribeEndpointList {
-			s.PostTransactionList(endpoint, batchTransactionList)
+	//process document list left
+	if len(batchDocumentList) > 0 {
+		post(batchDocumentList)
+	}
+	if lastErr != nil {
+		return int64(len(transactionList) - len(failedTransactionList)), &SinkError{
+			Sink:            endpoint,
+			TransactionList: failedTransactionList,
+			Err:             lastErr,
 		}
 	}
 	return int64(len(transactionList)), nil
 }
 
-func (s *HttpSaver) PostTransactionList(endpoint string, transactionList []Transaction) (int64, error) {
-	marshal, _ := json.Marshal(transactionList)
+func (s *HttpSaver) PostDocumentList(endpoint string, documentList []interface{}) (int64, error) {
+	marshal, _ := json.Marshal(documentList)
 	if s.compress {
 		marshal = snappy.Encode(nil, marshal)
 	}
@@ -53,12 +88,12 @@ func (s *HttpSaver) PostTransactionList(endpoint string, transactionList []Trans
 	if errs != nil && len(errs) > 0 && errs[0] != nil {
 		var err error
 		for _, err = range errs {
-			log.Errorf("request %v error, url %v, error %v", transactionList, endpoint, err)
+			log.Errorf("request %v error, url %v, error %v", documentList, endpoint, err)
 		}
 		return -1, err
 	} else if resp.StatusCode != 200 {
-		log.Errorf("request %v invalid, url %v, body %v", transactionList, endpoint, body)
-		return -1, nil
+		log.Errorf("request %v invalid, url %v, body %v", documentList, endpoint, body)
+		return -1, fmt.Errorf("url %v response status %v", endpoint, resp.StatusCode)
 	}
 	log.Debugf("request %v response body %v", endpoint, body)
 	type Result struct {
@@ -26,7 +26,6 @@ import (
 	"github.com/ethereum/go-ethereum/les"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/node"
-	"github.com/jinzhu/configor"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
@@ -197,7 +196,10 @@ func init() {
 	app.Action = geth
 	app.HideVersion = true // we have a command to print the version
 	app.Copyright = "Copyright 2013-2020 The go-ethereum Authors"
-	app.Commands = []cli.Command{}
+	app.Commands = []cli.Command{
+		exportCommand,
+		deadLetterCommand,
+	}
 	sort.Sort(cli.CommandsByName(app.Commands))
 
 	consoleFlags := []cli.Flag{utils.JSpathFlag, utils.ExecFlag, utils.PreloadJSFlag}
@@ -328,8 +330,8 @@ func geth(ctx *cli.Context) error {
 func startNode(ctx *cli.Context, stack *node.Node) {
 	//debug.Memsize.Add("node", stack)
 
-	var appConfig AppConfig
-	if err := configor.Load(&appConfig, "config.yml"); err != nil {
+	appConfig, err := loadAppConfig("config.yml")
+	if err != nil {
 		log.Criticalf("load config error: %v", err)
 		os.Exit(1)
 	}
@@ -337,7 +339,7 @@ func startNode(ctx *cli.Context, stack *node.Node) {
 	log.Infof("app config %v", string(marshal))
 
 	if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
-		return NewEtherQuery(&appConfig, ctx)
+		return NewEtherQuery(appConfig, ctx)
 	}); err != nil {
 		utils.Fatalf("Failed to register the ether query service: %v", err)
 	}
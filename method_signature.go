@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// bundledMethodSignatures are the text signatures known without any file.
+var bundledMethodSignatures = []string{
+	// ERC-20
+	"transfer(address,uint256)",
+	"transferFrom(address,address,uint256)",
+	"approve(address,uint256)",
+	"increaseAllowance(address,uint256)",
+	"decreaseAllowance(address,uint256)",
+	"mint(address,uint256)",
+	"burn(uint256)",
+	"burnFrom(address,uint256)",
+	"balanceOf(address)",
+	"allowance(address,address)",
+	"totalSupply()",
+	"name()",
+	"symbol()",
+	"decimals()",
+	// WETH
+	"deposit()",
+	"withdraw(uint256)",
+	// ERC-721
+	"safeTransferFrom(address,address,uint256)",
+	"safeTransferFrom(address,address,uint256,bytes)",
+	"setApprovalForAll(address,bool)",
+	"ownerOf(uint256)",
+	// ERC-1155
+	"safeTransferFrom(address,address,uint256,uint256,bytes)",
+	"safeBatchTransferFrom(address,address,uint256[],uint256[],bytes)",
+	// Uniswap V2 router
+	"swapExactTokensForTokens(uint256,uint256,address[],address,uint256)",
+	"swapTokensForExactTokens(uint256,uint256,address[],address,uint256)",
+	"swapExactETHForTokens(uint256,address[],address,uint256)",
+	"swapETHForExactTokens(uint256,address[],address,uint256)",
+	"swapExactTokensForETH(uint256,uint256,address[],address,uint256)",
+	"swapTokensForExactETH(uint256,uint256,address[],address,uint256)",
+	"addLiquidity(address,address,uint256,uint256,uint256,uint256,address,uint256)",
+	"addLiquidityETH(address,uint256,uint256,uint256,address,uint256)",
+	"removeLiquidity(address,address,uint256,uint256,uint256,address,uint256)",
+	"removeLiquidityETH(address,uint256,uint256,uint256,address,uint256)",
+	"multicall(bytes[])",
+}
+
+type methodSignature struct {
+	name      string
+	arguments abi.Arguments
+}
+
+// MethodSignatureDB decodes the call input of the methods it knows, keyed by
+// the 4 byte selector. A selector may have several signatures, the first one
+// the input decodes with wins.
+type MethodSignatureDB struct {
+	methods map[string][]*methodSignature
+}
+
+func NewMethodSignatureDB() *MethodSignatureDB {
+	s := &MethodSignatureDB{methods: map[string][]*methodSignature{}}
+	for _, signature := range bundledMethodSignatures {
+		if err := s.AddTextSignature(signature); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+// LoadMethodSignatureDB loads the bundled signatures plus the files of the
+// directory: *.txt with one text signature per line and *.json ABI files.
+func LoadMethodSignatureDB(dir string) (*MethodSignatureDB, error) {
+	s := NewMethodSignatureDB()
+	if dir == "" {
+		return s, nil
+	}
+	textFileList, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range textFileList {
+		//一个文件有错只跳过这个文件, 其他文件照常加载
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("skip signature file %v, read error %v", file, err)
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := s.AddTextSignature(line); err != nil {
+				log.Warnf("skip signature %v of %v: %v", line, file, err)
+			}
+		}
+	}
+	abiFileList, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range abiFileList {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("skip signature abi %v, read error %v", file, err)
+			continue
+		}
+		contractAbi, err := abi.JSON(bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("skip signature abi %v, load error %v", file, err)
+			continue
+		}
+		for _, method := range contractAbi.Methods {
+			s.add(hexutil.Encode(method.ID), &methodSignature{name: method.RawName, arguments: method.Inputs})
+		}
+	}
+	return s, nil
+}
+
+func (s *MethodSignatureDB) add(selector string, signature *methodSignature) {
+	for _, known := range s.methods[selector] {
+		if known.name == signature.name && len(known.arguments) == len(signature.arguments) {
+			return
+		}
+	}
+	s.methods[selector] = append(s.methods[selector], signature)
+}
+
+// AddTextSignature adds a signature like transfer(address,uint256). Tuple
+// arguments are not supported.
+func (s *MethodSignatureDB) AddTextSignature(text string) error {
+	text = strings.TrimSpace(text)
+	open := strings.Index(text, "(")
+	if open <= 0 || !strings.HasSuffix(text, ")") {
+		return fmt.Errorf("invalid signature %v", text)
+	}
+	typeText := text[open+1 : len(text)-1]
+	if strings.Contains(typeText, "(") {
+		return fmt.Errorf("tuple argument in %v", text)
+	}
+	name := strings.TrimSpace(text[:open])
+	arguments := abi.Arguments{}
+	typeList := []string{}
+	if strings.TrimSpace(typeText) != "" {
+		for _, t := range strings.Split(typeText, ",") {
+			typ, err := abi.NewType(strings.TrimSpace(t), "", nil)
+			if err != nil {
+				return err
+			}
+			arguments = append(arguments, abi.Argument{Type: typ})
+			typeList = append(typeList, typ.String())
+		}
+	}
+	//selector 按规范形式计算, 文本里的空格不影响
+	canonical := fmt.Sprintf("%v(%v)", name, strings.Join(typeList, ","))
+	selector := hexutil.Encode(crypto.Keccak256([]byte(canonical))[:4])
+	s.add(selector, &methodSignature{name: name, arguments: arguments})
+	return nil
+}
+
+// Decode fills MethodId, MethodName and MethodArgs of a record from its call
+// input, MethodName and MethodArgs only when the selector is known and the
+// arguments decode.
+func (s *MethodSignatureDB) Decode(transaction *Transaction) {
+	if len(transaction.Data) < 10 {
+		return
+	}
+	input, err := hexutil.Decode(string(transaction.Data))
+	if err != nil || len(input) < 4 {
+		return
+	}
+	transaction.MethodId = hexutil.Encode(input[:4])
+	for _, signature := range s.methods[transaction.MethodId] {
+		values, err := signature.arguments.UnpackValues(input[4:])
+		if err != nil {
+			continue
+		}
+		transaction.MethodName = signature.name
+		transaction.MethodArgs = make([]string, len(values))
+		for i, value := range values {
+			transaction.MethodArgs[i] = formatAbiValue(value)
+		}
+		return
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestMethodSignatureDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "custom.txt"), []byte("# 自定义\nexecute(address,uint256,bytes)\nbroken(\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("[{"), 0644)
+	//坏的文件不影响其他文件
+	db, err := LoadMethodSignatureDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := common.HexToAddress("0x0a")
+	packed, err := newTokenArguments("address", "uint256", "bytes").Pack(target, big.NewInt(3), []byte{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := crypto.Keccak256([]byte("execute(address,uint256,bytes)"))[:4]
+	transaction := &Transaction{Data: []byte(hexutil.Encode(append(selector, packed...)))}
+	db.Decode(transaction)
+	if transaction.MethodId != hexutil.Encode(selector) || transaction.MethodName != "execute" || len(transaction.MethodArgs) != 3 ||
+		transaction.MethodArgs[0] != target.String() || transaction.MethodArgs[1] != "3" || transaction.MethodArgs[2] != "0x0102" {
+		t.Fatalf("execute got %v", transaction)
+	}
+
+	//未知的方法只有 method_id
+	transaction = &Transaction{Data: []byte("0x12345678")}
+	db.Decode(transaction)
+	if transaction.MethodId != "0x12345678" || transaction.MethodName != "" {
+		t.Fatalf("unknown got %v", transaction)
+	}
+
+	//签名文本里有空格时按规范形式计算 selector
+	if err := db.AddTextSignature(" settle( address, uint256 ) "); err != nil {
+		t.Fatal(err)
+	}
+	packed, err = newTokenArguments("address", "uint256").Pack(target, big.NewInt(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector = crypto.Keccak256([]byte("settle(address,uint256)"))[:4]
+	transaction = &Transaction{Data: []byte(hexutil.Encode(append(selector, packed...)))}
+	db.Decode(transaction)
+	if transaction.MethodName != "settle" || len(transaction.MethodArgs) != 2 || transaction.MethodArgs[1] != "5" {
+		t.Fatalf("settle got %v", transaction)
+	}
+
+	//内置的签名
+	transaction = &Transaction{Data: []byte("0xd0e30db0")}
+	db.Decode(transaction)
+	if transaction.MethodName != "deposit" {
+		t.Fatalf("deposit got %v", transaction)
+	}
+}
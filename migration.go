@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var migrationJobPrefix = []byte("migration-")
+
+// Migration describes what changed in a data version and which records have
+// to be exported again to bring the sinks up to date.
+type Migration struct {
+	Version     uint64
+	Description string
+	FromBlock   uint64                              // 受影响的第一个区块
+	ToBlock     uint64                              // 受影响的最后一个区块, 0表示到升级时的lastBlock
+	Filter      func(transaction *Transaction) bool // 只重新导出符合条件的记录, nil表示全部
+	// 过滤条件依赖配置时由 configureMigrations 生成 Filter, 返回nil表示当前配置下没有受影响的记录
+	ConfigFilter func(appConfig *AppConfig) func(transaction *Transaction) bool
+	Skip         bool // 当前配置下没有受影响的记录
+}
+
+// Migrations lists what changed in every data version after 3, in version
+// order. Upgrading over a version without an entry here falls back to
+// exporting everything again from block 0.
+var Migrations = []Migration{
+	{
+		Version: 4,
+		//之前按交易hash查询receipt总是查不到, 交易状态和代币转账都缺失
+		Description: "token transfers now include ERC-721, mined transactions get their receipt status and token transfers",
+	},
+	{
+		Version:     5,
+		Description: "ERC-1155 TransferSingle and TransferBatch are exported",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.TokenType == TokenTypeERC1155
+		},
+	},
+	{
+		Version:     6,
+		Description: "transferFrom, approve, allowance, mint and burn calls get token info",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.MethodName != ""
+		},
+	},
+	{
+		Version:     7,
+		Description: "ERC-20 Approval events are exported and tracked as allowances",
+		Filter:      isApprovalEvent,
+	},
+	{
+		Version: 8,
+		//包装代币是配置的, 不一定是主网的 WETH9, 从头迁移, 只迁移配置的包装代币
+		Description:  "WETH Deposit and Withdrawal events are exported as token mint and burn",
+		ConfigFilter: wrappedTokenEventFilter,
+	},
+	{
+		Version:     9,
+		Description: "token records carry the symbol and decimals of the token",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.TokenType != TokenTypeDefault
+		},
+	},
+	{
+		Version:     10,
+		Description: "call records carry method_id, method_name and method_args decoded from the input",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.MethodId != ""
+		},
+	},
+	{
+		Version:     11,
+		Description: "contract creations are exported with the creator, the call path and the code hash",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.TokenType == TokenTypeContractCreation
+		},
+	},
+	{
+		Version:     12,
+		Description: "SELFDESTRUCT frames are exported with the beneficiary and the swept balance, calls under a failed frame are marked failed",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.OpCode == OpCodeSelfDestruct ||
+				transaction.InternalIndex != InternalIndexDefault && transaction.Status == TransactionStatusFailed
+		},
+	},
+	{
+		Version:     13,
+		Description: "internal records carry depth, parent_internal_index and output, internalcallmode exports calls without value",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.TokenType == TokenTypeDefault && transaction.InternalIndex != InternalIndexDefault
+		},
+	},
+	{
+		Version: 14,
+		//之前合约创建记录和同一个 internal index 的交易记录互相覆盖, 整个交易重新导出
+		Description: "contract creation records get sub_index 1 so they no longer share the key of the call record",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.TokenType == TokenTypeContractCreation
+		},
+	},
+	{
+		Version: 15,
+		//之前 ERC-721 的 transferFrom 按 ERC-20 导出, tokenId 成了数量
+		Description: "token calls keep the transaction sender as from, ERC-721 transferFrom and approve are no longer exported as ERC-20",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.InternalIndex == InternalIndexDefault && transaction.LogIndex.Sign() < 0 &&
+				(transaction.MethodName == "transferFrom" || transaction.MethodName == "approve" ||
+					transaction.MethodName == "mint" || transaction.MethodName == "burnFrom")
+		},
+	},
+	{
+		Version: 16,
+		//之前 value 模式下 parent_internal_index 指向没有导出的调用
+		Description: "parent_internal_index points at the nearest exported ancestor",
+		Filter: func(transaction *Transaction) bool {
+			return transaction.TokenType == TokenTypeDefault && transaction.InternalIndex != InternalIndexDefault
+		},
+	},
+}
+
+// wrappedTokenEventFilter selects the mints and burns of the configured
+// wrapped tokens.
+func wrappedTokenEventFilter(appConfig *AppConfig) func(transaction *Transaction) bool {
+	if len(appConfig.WrappedTokenAddressList) == 0 {
+		return nil
+	}
+	wrappedTokens := map[common.Address]bool{}
+	for _, address := range appConfig.WrappedTokenAddressList {
+		wrappedTokens[common.HexToAddress(address)] = true
+	}
+	return func(transaction *Transaction) bool {
+		return transaction.TokenType == TokenTypeToken && transaction.LogIndex.Sign() >= 0 &&
+			(transaction.From == zeroAddress || transaction.To == zeroAddress) &&
+			wrappedTokens[common.HexToAddress(transaction.ContractAddress)]
+	}
+}
+
+// configureMigrations returns a copy of the migrations with the filters that
+// depend on the config built.
+func configureMigrations(migrations []Migration, appConfig *AppConfig) []Migration {
+	configured := make([]Migration, len(migrations))
+	for i, migration := range migrations {
+		if migration.ConfigFilter != nil {
+			migration.Filter = migration.ConfigFilter(appConfig)
+			migration.Skip = migration.Filter == nil
+		}
+		configured[i] = migration
+	}
+	return configured
+}
+
+// MigrationJob is the persisted progress of a migration, it is exported in
+// the background while the head keeps being exported.
+type MigrationJob struct {
+	Version     uint64 `json:"version"`
+	Description string `json:"description"`
+	FromBlock   uint64 `json:"from_block"`
+	ToBlock     uint64 `json:"to_block"`
+	Next        uint64 `json:"next"` // 下一个要重新导出的区块
+}
+
+func findMigration(migrations []Migration, version uint64) (Migration, bool) {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// planMigrations returns the jobs that upgrade the data exported before
+// lastBlock from one data version to another. It returns false if a version
+// in between has no migration.
+func planMigrations(migrations []Migration, from uint64, to uint64, lastBlock uint64, startBlock uint64) ([]*MigrationJob, bool) {
+	var jobList []*MigrationJob
+	for version := from + 1; version <= to; version++ {
+		migration, ok := findMigration(migrations, version)
+		if !ok {
+			return nil, false
+		}
+		if migration.Skip {
+			continue
+		}
+		job := &MigrationJob{
+			Version:     version,
+			Description: migration.Description,
+			FromBlock:   migration.FromBlock,
+			ToBlock:     migration.ToBlock,
+		}
+		if job.FromBlock < startBlock {
+			job.FromBlock = startBlock
+		}
+		if job.ToBlock == 0 || job.ToBlock >= lastBlock {
+			//lastBlock之后的区块会用新版本导出
+			if lastBlock == 0 {
+				continue
+			}
+			job.ToBlock = lastBlock - 1
+		}
+		if job.FromBlock > job.ToBlock {
+			continue
+		}
+		job.Next = job.FromBlock
+		jobList = append(jobList, job)
+	}
+	return jobList, true
+}
+
+func migrationJobKey(version uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", migrationJobPrefix, version))
+}
+
+func putMigrationJob(db ethdb.Database, job *MigrationJob) error {
+	marshal, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return db.Put(migrationJobKey(job.Version), marshal)
+}
+
+// loadMigrationJobs returns the unfinished migration jobs in version order.
+func loadMigrationJobs(db ethdb.Database) []*MigrationJob {
+	jobList := []*MigrationJob{}
+	it := db.NewIterator(migrationJobPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		job := &MigrationJob{}
+		if err := json.Unmarshal(it.Value(), job); err != nil {
+			log.Errorf("unmarshal migration job %v error %v", string(it.Key()), err)
+			continue
+		}
+		jobList = append(jobList, job)
+	}
+	return jobList
+}
+
+// clearMigrationJobs drops the unfinished migration jobs, used when the whole
+// chain is exported again anyway.
+func clearMigrationJobs(db ethdb.Database) {
+	for _, job := range loadMigrationJobs(db) {
+		if err := db.Delete(migrationJobKey(job.Version)); err != nil {
+			log.Errorf("delete migration job %v error %v", job.Version, err)
+		}
+	}
+}
+
+// selectTransactions returns every record of the transactions that have a
+// record passing the filter. A tree sink replaces the whole document of a
+// transaction, so a transaction is never sent in part.
+func selectTransactions(transactionList []Transaction, filter func(transaction *Transaction) bool) []Transaction {
+	if filter == nil {
+		return transactionList
+	}
+	selected := map[string]bool{}
+	for i := range transactionList {
+		if filter(&transactionList[i]) {
+			selected[transactionList[i].Hash] = true
+		}
+	}
+	var result []Transaction
+	for _, transaction := range transactionList {
+		if selected[transaction.Hash] {
+			result = append(result, transaction)
+		}
+	}
+	return result
+}
+
+// mergeMigrationJobs splits the jobs into the ones to run and the filtered
+// ones whose remaining blocks an unfiltered job exports again anyway.
+func mergeMigrationJobs(migrations []Migration, jobList []*MigrationJob) ([]*MigrationJob, []*MigrationJob) {
+	var runList, coveredList []*MigrationJob
+	for _, job := range jobList {
+		covered := false
+		if migration, _ := findMigration(migrations, job.Version); migration.Filter != nil {
+			for _, other := range jobList {
+				otherMigration, _ := findMigration(migrations, other.Version)
+				if otherMigration.Filter == nil && other.Next <= job.Next && other.ToBlock >= job.ToBlock {
+					covered = true
+					break
+				}
+			}
+		}
+		if covered {
+			coveredList = append(coveredList, job)
+		} else {
+			runList = append(runList, job)
+		}
+	}
+	return runList, coveredList
+}
+
+// migrationFilter returns the jobs that still have to export a block and the
+// union of their filters, nil if one of them exports every record.
+func migrationFilter(migrations []Migration, jobList []*MigrationJob, number uint64) (func(transaction *Transaction) bool, []*MigrationJob) {
+	var activeList []*MigrationJob
+	var filterList []func(transaction *Transaction) bool
+	all := false
+	for _, job := range jobList {
+		if number < job.Next || number > job.ToBlock {
+			continue
+		}
+		activeList = append(activeList, job)
+		migration, _ := findMigration(migrations, job.Version)
+		if migration.Filter == nil {
+			all = true
+		}
+		filterList = append(filterList, migration.Filter)
+	}
+	if all || len(filterList) == 0 {
+		return nil, activeList
+	}
+	return func(transaction *Transaction) bool {
+		for _, filter := range filterList {
+			if filter(transaction) {
+				return true
+			}
+		}
+		return false
+	}, activeList
+}
+
+// runMigrations exports the blocks affected by the unfinished migrations
+// again in one pass: every block is traced once and the records passing any
+// of its jobs are exported. The progress of each job is saved per block, so a
+// restart resumes where it stopped.
+func (s *EtherQuery) runMigrations() {
+	chain := s.ethereum.BlockChain()
+	var jobList []*MigrationJob
+	for _, job := range loadMigrationJobs(s.customDatabase) {
+		migration, ok := findMigration(s.migrations, job.Version)
+		if !ok {
+			log.Errorf("migration %v is not registered, drop it", job.Version)
+			s.customDatabase.Delete(migrationJobKey(job.Version))
+			continue
+		}
+		if migration.Skip {
+			log.Infof("migration %v has no records to export with the current config, drop it", job.Version)
+			s.customDatabase.Delete(migrationJobKey(job.Version))
+			continue
+		}
+		jobList = append(jobList, job)
+	}
+	jobList, coveredList := mergeMigrationJobs(s.migrations, jobList)
+	for _, job := range coveredList {
+		//没有过滤条件的迁移会重新导出这些区块的全部记录
+		log.Infof("migration %v block %v-%v is covered by a full migration, drop it", job.Version, job.Next, job.ToBlock)
+		if err := s.customDatabase.Delete(migrationJobKey(job.Version)); err != nil {
+			log.Errorf("delete migration job %v error %v", job.Version, err)
+		}
+	}
+	if len(jobList) == 0 {
+		return
+	}
+	from, to := jobList[0].Next, jobList[0].ToBlock
+	for _, job := range jobList {
+		log.Infof("migration %v (%v) block %v-%v from %v", job.Version, job.Description, job.FromBlock, job.ToBlock, job.Next)
+		if job.Next < from {
+			from = job.Next
+		}
+		if job.ToBlock > to {
+			to = job.ToBlock
+		}
+	}
+	for number := from; number <= to; number++ {
+		filter, activeList := migrationFilter(s.migrations, jobList, number)
+		if len(activeList) == 0 {
+			continue
+		}
+		if s.ctx.Err() != nil {
+			log.Infof("migration stopped at block %v", number)
+			return
+		}
+		block := chain.GetBlockByNumber(number)
+		if block == nil {
+			log.Errorf("migration block %v not found", number)
+			return
+		}
+		transactionList := selectTransactions(s.exporter.BuildBlock(block), filter)
+		//授权按区块和日志序号排序, 迁移晚于新区块写入也不会覆盖
+		s.allowances.Apply(transactionList)
+		s.contracts.Apply(transactionList)
+		if len(transactionList) > 0 {
+			effects, err := s.exporter.SaveTransactionList(transactionList)
+			if err != nil {
+				log.Errorf("migration block %v error %v", number, err)
+				s.queueDeadLetters(number, err, transactionList)
+			}
+			log.Debugf("migration block %v jobs %v effects %v", number, len(activeList), effects)
+		}
+		//保存进度
+		for _, job := range activeList {
+			job.Next = number + 1
+			if job.Next <= job.ToBlock {
+				if err := putMigrationJob(s.customDatabase, job); err != nil {
+					log.Errorf("put migration job %v error %v", job.Version, err)
+				}
+				continue
+			}
+			if err := s.customDatabase.Delete(migrationJobKey(job.Version)); err != nil {
+				log.Errorf("delete migration job %v error %v", job.Version, err)
+			}
+			log.Infof("migration %v finished", job.Version)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestPlanMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: 4, Description: "all"},
+		{Version: 5, Description: "range", FromBlock: 100, ToBlock: 200},
+		{Version: 6, Description: "after last block", FromBlock: 2000},
+	}
+	jobList, ok := planMigrations(migrations, 3, 6, 1000, 10)
+	if !ok || len(jobList) != 2 {
+		t.Fatalf("got %v %v", jobList, ok)
+	}
+	if job := jobList[0]; job.FromBlock != 10 || job.ToBlock != 999 || job.Next != 10 {
+		t.Fatalf("job 4 got %+v", job)
+	}
+	if job := jobList[1]; job.FromBlock != 100 || job.ToBlock != 200 {
+		t.Fatalf("job 5 got %+v", job)
+	}
+
+	//缺少版本的迁移
+	if _, ok := planMigrations(migrations, 2, 6, 1000, 0); ok {
+		t.Fatalf("planned over the missing version 3")
+	}
+}
+
+func TestMigrationJobs(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	putMigrationJob(db, &MigrationJob{Version: 5, Next: 7})
+	putMigrationJob(db, &MigrationJob{Version: 4, Next: 3})
+	jobList := loadMigrationJobs(db)
+	if len(jobList) != 2 || jobList[0].Version != 4 || jobList[1].Next != 7 {
+		t.Fatalf("got %v", jobList)
+	}
+	clearMigrationJobs(db)
+	if jobList := loadMigrationJobs(db); len(jobList) != 0 {
+		t.Fatalf("got %v after clear", jobList)
+	}
+}
+
+func TestSelectTransactions(t *testing.T) {
+	transactionList := []Transaction{
+		{Hash: "0x01", TokenType: TokenTypeERC1155},
+		{Hash: "0x01", InternalIndex: InternalIndexDefault},
+		{Hash: "0x02", InternalIndex: InternalIndexDefault},
+	}
+	//只有一条记录符合条件, 整个交易都重新导出
+	selected := selectTransactions(transactionList, func(transaction *Transaction) bool {
+		return transaction.TokenType == TokenTypeERC1155
+	})
+	if len(selected) != 2 || selected[1].Hash != "0x01" {
+		t.Fatalf("got %v", selected)
+	}
+	if len(selectTransactions(transactionList, nil)) != 3 {
+		t.Fatalf("nil filter should select everything")
+	}
+}
+
+func TestMergeMigrationJobs(t *testing.T) {
+	isERC1155 := func(transaction *Transaction) bool {
+		return transaction.TokenType == TokenTypeERC1155
+	}
+	isContractCreation := func(transaction *Transaction) bool {
+		return transaction.TokenType == TokenTypeContractCreation
+	}
+	migrations := []Migration{
+		{Version: 4},
+		{Version: 5, Filter: isERC1155},
+		{Version: 6, Filter: isContractCreation},
+	}
+	jobList := []*MigrationJob{
+		{Version: 4, Next: 10, ToBlock: 100},
+		{Version: 5, Next: 20, ToBlock: 100},
+		{Version: 6, Next: 0, ToBlock: 200},
+	}
+	//5 在 4 的范围内, 6 超出了 4 的范围
+	runList, coveredList := mergeMigrationJobs(migrations, jobList)
+	if len(runList) != 2 || runList[1].Version != 6 || len(coveredList) != 1 || coveredList[0].Version != 5 {
+		t.Fatalf("got %v %v", runList, coveredList)
+	}
+
+	filter, activeList := migrationFilter(migrations, runList, 50)
+	if filter != nil || len(activeList) != 2 {
+		t.Fatalf("block 50 got %v jobs", len(activeList))
+	}
+	filter, activeList = migrationFilter(migrations, jobList[1:], 50)
+	if filter == nil || len(activeList) != 2 {
+		t.Fatalf("block 50 of filtered jobs got %v jobs", len(activeList))
+	}
+	if !filter(&Transaction{TokenType: TokenTypeERC1155}) || !filter(&Transaction{TokenType: TokenTypeContractCreation}) ||
+		filter(&Transaction{TokenType: TokenTypeToken}) {
+		t.Fatalf("filter is not the union of the job filters")
+	}
+	if _, activeList := migrationFilter(migrations, runList, 150); len(activeList) != 1 || activeList[0].Version != 6 {
+		t.Fatalf("block 150 got %v", activeList)
+	}
+}
+
+func TestConfigureMigrations(t *testing.T) {
+	weth := "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"
+	migrations := configureMigrations(Migrations, &AppConfig{WrappedTokenAddressList: []string{weth}})
+	migration, _ := findMigration(migrations, 8)
+	if migration.Skip || migration.Filter == nil {
+		t.Fatalf("got %+v", migration)
+	}
+	//只有配置的包装代币的铸造和销毁
+	mint := &Transaction{TokenType: TokenTypeToken, From: zeroAddress, ContractAddress: common.HexToAddress(weth).String(), LogIndex: *big.NewInt(0)}
+	if !migration.Filter(mint) {
+		t.Fatalf("wrapped token mint not selected")
+	}
+	mint.ContractAddress = common.HexToAddress("0x0a").String()
+	if migration.Filter(mint) {
+		t.Fatalf("other token mint selected")
+	}
+
+	//没有配置包装代币时不迁移
+	migrations = configureMigrations(Migrations, &AppConfig{})
+	if migration, _ := findMigration(migrations, 8); !migration.Skip {
+		t.Fatalf("got %+v", migration)
+	}
+	jobList, ok := planMigrations(migrations, 7, 8, 1000, 0)
+	if !ok || len(jobList) != 0 {
+		t.Fatalf("got %v %v", jobList, ok)
+	}
+}
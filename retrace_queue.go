@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var retracePrefix = []byte("retrace-")
+
+// RetraceTask is a transaction whose trace timed out, waiting to be traced
+// again with a bigger timeout.
+type RetraceTask struct {
+	Key              string `json:"key"`
+	BlockNumber      uint64 `json:"block_number"`
+	BlockHash        string `json:"block_hash"`
+	Hash             string `json:"hash"`
+	TransactionIndex uint64 `json:"transaction_index"`
+	Timeout          string `json:"timeout"` // 下一次跟踪的超时
+	Attempts         uint64 `json:"attempts"`
+	Err              string `json:"err"`
+	CreateTime       int64  `json:"create_time"`
+	NextAttemptTime  int64  `json:"next_attempt_time"`
+}
+
+// RetraceQueue persists the transactions whose trace timed out in the
+// database, they are traced again in the background with a timeout doubled
+// on every attempt.
+type RetraceQueue struct {
+	db            ethdb.Database
+	timeout       time.Duration
+	maxTimeout    time.Duration
+	maxAttempts   uint64
+	retryInterval time.Duration
+	lock          sync.Mutex
+}
+
+func NewRetraceQueue(appConfig *AppConfig, db ethdb.Database) *RetraceQueue {
+	timeout, err := time.ParseDuration(appConfig.RetraceTimeout)
+	if err != nil || timeout <= 0 {
+		timeout = time.Minute
+	}
+	maxTimeout, err := time.ParseDuration(appConfig.RetraceMaxTimeout)
+	if err != nil || maxTimeout < timeout {
+		maxTimeout = 10 * timeout
+	}
+	retryInterval, err := time.ParseDuration(appConfig.RetraceInterval)
+	if err != nil || retryInterval <= 0 {
+		retryInterval = time.Minute
+	}
+	maxAttempts := appConfig.RetraceMaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = 5
+	}
+	return &RetraceQueue{
+		db:            db,
+		timeout:       timeout,
+		maxTimeout:    maxTimeout,
+		maxAttempts:   maxAttempts,
+		retryInterval: retryInterval,
+	}
+}
+
+func retraceKey(blockNumber uint64, blockHash string, hash string) []byte {
+	return []byte(fmt.Sprintf("%s%020d-%s-%s", retracePrefix, blockNumber, blockHash, hash))
+}
+
+// isTraceTimeout tells whether a record is the top level record of a
+// transaction whose trace timed out.
+func isTraceTimeout(transaction *Transaction) bool {
+	return transaction.Status == TransactionStatusTimeout && transaction.InternalIndex == InternalIndexDefault &&
+		transaction.LogIndex.Sign() < 0 && transaction.TokenType != TokenTypeContractCreation
+}
+
+// Put queues the transactions of the records whose trace timed out, a
+// transaction already queued keeps its attempts.
+func (s *RetraceQueue) Put(transactionList []Transaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		if !isTraceTimeout(transaction) {
+			continue
+		}
+		key := retraceKey(transaction.BlockNumber.Uint64(), transaction.BlockHash, transaction.Hash)
+		if ok, _ := s.db.Has(key); ok {
+			continue
+		}
+		task := &RetraceTask{
+			Key:              string(key),
+			BlockNumber:      transaction.BlockNumber.Uint64(),
+			BlockHash:        transaction.BlockHash,
+			Hash:             transaction.Hash,
+			TransactionIndex: transaction.TransactionIndex.Uint64(),
+			Timeout:          s.timeout.String(),
+			CreateTime:       now.Unix(),
+			NextAttemptTime:  now.Add(s.retryInterval).Unix(),
+		}
+		if err := s.put(task); err != nil {
+			log.Errorf("put retrace task %v error %v", task.Key, err)
+			continue
+		}
+		log.Warnf("transaction %v of block %v queued for retrace", task.Hash, task.BlockNumber)
+	}
+}
+
+func (s *RetraceQueue) put(task *RetraceTask) error {
+	marshal, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(task.Key), marshal)
+}
+
+func (s *RetraceQueue) iterate(f func(task *RetraceTask)) {
+	it := s.db.NewIterator(retracePrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		task := &RetraceTask{}
+		if err := json.Unmarshal(it.Value(), task); err != nil {
+			log.Errorf("unmarshal retrace task %v error %v", string(it.Key()), err)
+			continue
+		}
+		f(task)
+	}
+}
+
+// List returns the queued transactions in block order.
+func (s *RetraceQueue) List() []*RetraceTask {
+	taskList := []*RetraceTask{}
+	s.iterate(func(task *RetraceTask) {
+		taskList = append(taskList, task)
+	})
+	return taskList
+}
+
+// Due returns the tasks whose next attempt time has come.
+func (s *RetraceQueue) Due(now time.Time) []*RetraceTask {
+	var taskList []*RetraceTask
+	s.iterate(func(task *RetraceTask) {
+		if task.NextAttemptTime <= now.Unix() {
+			taskList = append(taskList, task)
+		}
+	})
+	return taskList
+}
+
+// Fail records a failed attempt. After a timeout the next attempt gets twice
+// the timeout, up to the maximum. The task is dropped after the last attempt.
+func (s *RetraceQueue) Fail(task *RetraceTask, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	task.Attempts++
+	task.Err = err.Error()
+	if task.Attempts >= s.maxAttempts {
+		log.Errorf("retrace transaction %v of block %v failed %v times, give up, error %v", task.Hash, task.BlockNumber, task.Attempts, err)
+		if err := s.db.Delete([]byte(task.Key)); err != nil {
+			log.Errorf("delete retrace task %v error %v", task.Key, err)
+		}
+		return
+	}
+	if err == errTraceTimeout {
+		timeout, parseErr := time.ParseDuration(task.Timeout)
+		if parseErr != nil {
+			timeout = s.timeout
+		}
+		if timeout *= 2; timeout > s.maxTimeout {
+			timeout = s.maxTimeout
+		}
+		task.Timeout = timeout.String()
+	}
+	task.NextAttemptTime = time.Now().Add(s.retryInterval).Unix()
+	if err := s.put(task); err != nil {
+		log.Errorf("update retrace task %v error %v", task.Key, err)
+	}
+	log.Warnf("retrace transaction %v attempt %v error %v, next timeout %v", task.Hash, task.Attempts, err, task.Timeout)
+}
+
+// Done removes a task.
+func (s *RetraceQueue) Done(task *RetraceTask) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.db.Delete([]byte(task.Key)); err != nil {
+		log.Errorf("delete retrace task %v error %v", task.Key, err)
+	}
+}
+
+// runRetraces traces the queued transactions again in the background until
+// the service stops.
+func (s *EtherQuery) runRetraces() {
+	ticker := time.NewTicker(s.retraceQueue.retryInterval)
+	defer ticker.Stop()
+	for {
+		for _, task := range s.retraceQueue.Due(time.Now()) {
+			if task.BlockNumber >= s.watermark.Next() && !s.watermark.DoneAhead(task.BlockNumber) {
+				//区块还没有保存, 之后保存的超时记录会覆盖重新跟踪的结果
+				continue
+			}
+			err := s.retrace(task)
+			if s.ctx.Err() != nil {
+				//停止时被中断的不算一次尝试
+				return
+			}
+			if err != nil {
+				s.retraceQueue.Fail(task, err)
+			} else {
+				s.retraceQueue.Done(task)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// retrace traces a queued transaction again with the timeout of its task, and
+// exports its corrected records with the updated status. The records replace
+// the journaled ones, so a later reorg retracts them too.
+func (s *EtherQuery) retrace(task *RetraceTask) error {
+	chain := s.ethereum.BlockChain()
+	blockHash := common.HexToHash(task.BlockHash)
+	if chain.GetCanonicalHash(task.BlockNumber) != blockHash {
+		//区块已经被回滚, 它的记录已经撤销
+		log.Warnf("retrace transaction %v skipped, block %v %v reorged out", task.Hash, task.BlockNumber, task.BlockHash)
+		return nil
+	}
+	block := chain.GetBlock(blockHash, task.BlockNumber)
+	if block == nil {
+		return fmt.Errorf("block %v %v not found", task.BlockNumber, task.BlockHash)
+	}
+	timeout, err := time.ParseDuration(task.Timeout)
+	if err != nil {
+		timeout = s.retraceQueue.timeout
+	}
+	startTime := time.Now()
+	transactionList, err := s.exporter.RetraceTransaction(s.ctx, block, int(task.TransactionIndex), timeout)
+	if err != nil {
+		return err
+	}
+	s.journal.ReplaceTransaction(task.BlockNumber, blockHash, task.Hash, transactionList)
+	s.contracts.Apply(transactionList)
+	effects, err := s.exporter.SaveTransactionList(transactionList)
+	if err != nil {
+		log.Errorf("save retraced transaction %v error %v", task.Hash, err)
+		s.queueDeadLetters(task.BlockNumber, err, transactionList)
+	}
+	log.Infof("retrace transaction %v of block %v succeeded in %vms, effects %v", task.Hash, task.BlockNumber, time.Since(startTime).Milliseconds(), effects)
+	return nil
+}
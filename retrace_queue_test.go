@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestRetraceQueue(t *testing.T) {
+	appConfig := &AppConfig{RetraceTimeout: "1m", RetraceMaxTimeout: "3m", RetraceMaxAttempts: 3, RetraceInterval: "10s"}
+	queue := NewRetraceQueue(appConfig, rawdb.NewMemoryDatabase())
+	timeout := Transaction{
+		BlockNumber:      *big.NewInt(7),
+		BlockHash:        "0xb7",
+		Hash:             "0x01",
+		TransactionIndex: *big.NewInt(2),
+		LogIndex:         *LogIndexDefault,
+		InternalIndex:    InternalIndexDefault,
+		Status:           TransactionStatusTimeout,
+	}
+	//代币记录和合约创建记录带有同样的状态, 只按交易本身的记录排队
+	transfer := timeout
+	transfer.LogIndex = *big.NewInt(0)
+	creation := timeout
+	creation.TokenType = TokenTypeContractCreation
+	success := timeout
+	success.Hash = "0x02"
+	success.Status = TransactionStatusSuccess
+	queue.Put([]Transaction{transfer, creation, timeout, success})
+
+	taskList := queue.List()
+	if len(taskList) != 1 || taskList[0].Hash != "0x01" || taskList[0].TransactionIndex != 2 || taskList[0].Timeout != "1m0s" {
+		t.Fatalf("got %+v", taskList)
+	}
+	if len(queue.Due(time.Now())) != 0 || len(queue.Due(time.Now().Add(time.Minute))) != 1 {
+		t.Fatalf("task should be due after the interval")
+	}
+
+	//超时后加倍, 不超过最大值, 其他错误不改超时
+	task := taskList[0]
+	queue.Fail(task, errTraceTimeout)
+	queue.Put([]Transaction{timeout})
+	if task = queue.List()[0]; task.Attempts != 1 || task.Timeout != "2m0s" {
+		t.Fatalf("got %+v", task)
+	}
+	queue.Fail(task, errors.New("missing trie node"))
+	if task = queue.List()[0]; task.Attempts != 2 || task.Timeout != "2m0s" || task.Err != "missing trie node" {
+		t.Fatalf("got %+v", task)
+	}
+	queue.Fail(task, errTraceTimeout)
+	if len(queue.List()) != 0 {
+		t.Fatalf("task should be dropped after %v attempts", appConfig.RetraceMaxAttempts)
+	}
+
+	queue.Put([]Transaction{timeout})
+	task = queue.List()[0]
+	queue.Fail(task, errTraceTimeout)
+	queue.Fail(task, errTraceTimeout)
+	if task = queue.List()[0]; task.Timeout != "3m0s" {
+		t.Fatalf("got %+v", task)
+	}
+	queue.Done(task)
+	if len(queue.List()) != 0 {
+		t.Fatalf("task should be removed")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+
 	log "github.com/cihub/seelog"
 )
 
@@ -9,13 +12,128 @@ type Saver interface {
 	SaveTransactionList(transactionList []Transaction) (int64, error)
 }
 
+// SinkSaver is implemented by savers that write to several sinks, so that a
+// batch which failed on one sink can be saved to that sink alone.
+type SinkSaver interface {
+	SaveToSink(sink string, transactionList []Transaction) (int64, error)
+}
+
+// SinkError holds the records a single sink failed to save.
+type SinkError struct {
+	Sink            string
+	TransactionList []Transaction
+	Err             error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("sink %v failed to save %v records: %v", e.Sink, len(e.TransactionList), e.Err)
+}
+
+// SaveError is returned by a saver when one or more of its sinks failed.
+type SaveError []*SinkError
+
+func (e SaveError) Error() string {
+	var messageList []string
+	for _, sinkError := range e {
+		messageList = append(messageList, sinkError.Error())
+	}
+	return strings.Join(messageList, "; ")
+}
+
+// configuredSinks returns the sinks of the configured saver: the endpoints of
+// the http saver, the saver name for the others.
+func configuredSinks(appConfig *AppConfig) []string {
+	if appConfig.Saver == "http" {
+		return appConfig.SubscribeEndpointList
+	}
+	return []string{appConfig.Saver}
+}
+
+// SplitSaveError sorts the failures of a save by the policy of their sinks.
+// Failures of ignored sinks are logged and dropped. An error that does not
+// come per sink is a failure of every configured sink.
+func SplitSaveError(appConfig *AppConfig, err error, transactionList []Transaction) (required SaveError, bestEffort SaveError) {
+	if err == nil {
+		return nil, nil
+	}
+	saveError, ok := err.(SaveError)
+	if !ok {
+		for _, sink := range configuredSinks(appConfig) {
+			saveError = append(saveError, &SinkError{Sink: sink, TransactionList: transactionList, Err: err})
+		}
+	}
+	for _, sinkError := range saveError {
+		switch appConfig.GetSinkPolicy(sinkError.Sink) {
+		case SinkPolicyRequired:
+			required = append(required, sinkError)
+		case SinkPolicyIgnore:
+			log.Warnf("ignore save error %v", sinkError)
+		default:
+			bestEffort = append(bestEffort, sinkError)
+		}
+	}
+	return required, bestEffort
+}
+
+// sinkDocument is a document sent to a sink and the records it was built from.
+type sinkDocument struct {
+	document        interface{}
+	transactionList []Transaction
+}
+
+// buildSinkDocuments converts the records to the format of the sink: one
+// document per record in flat format, one per transaction in tree format.
+func buildSinkDocuments(appConfig *AppConfig, sink string, transactionList []Transaction) []sinkDocument {
+	var documentList []sinkDocument
+	if appConfig.GetSinkFormat(sink) == SinkFormatTree {
+		for _, tree := range BuildTransactionTrees(transactionList) {
+			documentList = append(documentList, sinkDocument{document: tree, transactionList: tree.transactionList})
+		}
+		return documentList
+	}
+	for i := range transactionList {
+		//big.Int 字段要通过指针才能正确序列化
+		transaction := stripCallTree(transactionList[i])
+		documentList = append(documentList, sinkDocument{document: &transaction, transactionList: transactionList[i : i+1]})
+	}
+	return documentList
+}
+
+func NewSaver(appConfig *AppConfig) Saver {
+	var saver Saver = &MongoSaver{}
+	if appConfig.Saver == "mongo" {
+		saver = &MongoSaver{
+			appConfig: appConfig,
+		}
+	} else if appConfig.Saver == "http" {
+		saver = &HttpSaver{
+			appConfig: appConfig,
+		}
+	} else {
+		saver = &DummySaver{
+			appConfig: appConfig,
+		}
+	}
+	return saver
+}
+
+// SaveToSink saves the records to one sink of the saver, savers with a single
+// sink simply save them.
+func SaveToSink(saver Saver, sink string, transactionList []Transaction) (int64, error) {
+	if sinkSaver, ok := saver.(SinkSaver); ok {
+		return sinkSaver.SaveToSink(sink, transactionList)
+	}
+	return saver.SaveTransactionList(transactionList)
+}
+
 type DummySaver struct {
 	appConfig *AppConfig
 }
 
 func (s *DummySaver) SaveTransactionList(transactionList []Transaction) (int64, error) {
-	if len(transactionList) == 1 {
-		marshal, _ := json.Marshal(transactionList)
+	documentList := buildSinkDocuments(s.appConfig, s.appConfig.Saver, transactionList)
+	if len(documentList) == 1 {
+		marshal, _ := json.Marshal([]interface{}{documentList[0].document})
 		log.Infof("%v", string(marshal))
 	}
 	return int64(len(transactionList)), nil
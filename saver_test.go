@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSplitSaveError(t *testing.T) {
+	appConfig := &AppConfig{
+		Saver:      "http",
+		SinkPolicy: map[string]string{"http://a": SinkPolicyRequired, "http://c": SinkPolicyIgnore},
+	}
+	err := SaveError{
+		{Sink: "http://a", Err: errors.New("down")},
+		{Sink: "http://b", Err: errors.New("down")},
+		{Sink: "http://c", Err: errors.New("down")},
+	}
+	required, bestEffort := SplitSaveError(appConfig, err, nil)
+	if len(required) != 1 || required[0].Sink != "http://a" {
+		t.Fatalf("required got %v", required)
+	}
+	if len(bestEffort) != 1 || bestEffort[0].Sink != "http://b" {
+		t.Fatalf("best-effort got %v", bestEffort)
+	}
+
+	//不是按sink返回的错误算作每个配置的sink都失败
+	appConfig.DefaultSinkPolicy = SinkPolicyRequired
+	appConfig.SubscribeEndpointList = []string{"http://a", "http://b"}
+	required, _ = SplitSaveError(appConfig, errors.New("down"), []Transaction{{Hash: "0x01"}})
+	if len(required) != 2 || required[0].Sink != "http://a" || required[1].Sink != "http://b" || len(required[1].TransactionList) != 1 {
+		t.Fatalf("required got %v", required)
+	}
+	appConfig.Saver = "mongo"
+	required, _ = SplitSaveError(appConfig, errors.New("down"), nil)
+	if len(required) != 1 || required[0].Sink != "mongo" {
+		t.Fatalf("required got %v", required)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math/big"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var zeroAddress = common.Address{}.String()
+
+// tokenMethod is an ERC-20 method whose call is exported as token info of the
+// transaction.
+type tokenMethod struct {
+	name      string
+	arguments abi.Arguments
+	// decode fills the record from the decoded arguments, sender is the
+	// account that sent the call
+	decode func(transaction *Transaction, sender string, values []interface{})
+	// decodeERC721 decodes the method of the same selector of ERC-721, nil if
+	// the call of an ERC-721 contract is not a token call
+	decodeERC721 func(transaction *Transaction, sender string, values []interface{})
+}
+
+func newTokenArguments(typeList ...string) abi.Arguments {
+	arguments := abi.Arguments{}
+	for _, t := range typeList {
+		typ, err := abi.NewType(t, "", nil)
+		if err != nil {
+			panic(err)
+		}
+		arguments = append(arguments, abi.Argument{Type: typ})
+	}
+	return arguments
+}
+
+func decodeSpend(transaction *Transaction, sender string, values []interface{}) {
+	transaction.Spender = values[0].(common.Address).String()
+	transaction.To = transaction.Spender
+	transaction.TokenValue = *values[1].(*big.Int)
+	transaction.TokenType = TokenTypeApproval
+}
+
+// tokenMethods is keyed by the method selector.
+var tokenMethods = map[string]*tokenMethod{
+	// transfer(address _to, uint256 _value)
+	"0xa9059cbb": {
+		name:      "transfer",
+		arguments: newTokenArguments("address", "uint256"),
+		decode: func(transaction *Transaction, sender string, values []interface{}) {
+			transaction.To = values[0].(common.Address).String()
+			transaction.TokenValue = *values[1].(*big.Int)
+			transaction.TokenType = TokenTypeToken
+		},
+	},
+	// transferFrom(address _from, address _to, uint256 _value)
+	"0x23b872dd": {
+		name:      "transferFrom",
+		arguments: newTokenArguments("address", "address", "uint256"),
+		decode: func(transaction *Transaction, sender string, values []interface{}) {
+			transaction.To = values[1].(common.Address).String()
+			transaction.TokenValue = *values[2].(*big.Int)
+			transaction.Spender = sender
+			transaction.TokenType = TokenTypeToken
+		},
+		// ERC-721 transferFrom(address _from, address _to, uint256 _tokenId)
+		decodeERC721: func(transaction *Transaction, sender string, values []interface{}) {
+			transaction.To = values[1].(common.Address).String()
+			transaction.TokenId = *values[2].(*big.Int)
+			transaction.TokenValue.SetUint64(1)
+			transaction.Spender = sender
+			transaction.TokenType = TokenTypeERC721
+		},
+	},
+	// approve(address _spender, uint256 _value)
+	// ERC-721 的 approve(address _approved, uint256 _tokenId) 只授权一个 token, 不是代币授权
+	"0x095ea7b3": {
+		name:      "approve",
+		arguments: newTokenArguments("address", "uint256"),
+		decode:    decodeSpend,
+	},
+	// increaseAllowance(address spender, uint256 addedValue)
+	"0x39509351": {
+		name:      "increaseAllowance",
+		arguments: newTokenArguments("address", "uint256"),
+		decode:    decodeSpend,
+	},
+	// decreaseAllowance(address spender, uint256 subtractedValue)
+	"0xa457c2d7": {
+		name:      "decreaseAllowance",
+		arguments: newTokenArguments("address", "uint256"),
+		decode:    decodeSpend,
+	},
+	// mint(address to, uint256 amount)
+	"0x40c10f19": {
+		name:      "mint",
+		arguments: newTokenArguments("address", "uint256"),
+		decode: func(transaction *Transaction, sender string, values []interface{}) {
+			transaction.To = values[0].(common.Address).String()
+			transaction.TokenValue = *values[1].(*big.Int)
+			transaction.TokenType = TokenTypeToken
+		},
+	},
+	// burn(uint256 value)
+	"0x42966c68": {
+		name:      "burn",
+		arguments: newTokenArguments("uint256"),
+		decode: func(transaction *Transaction, sender string, values []interface{}) {
+			transaction.To = zeroAddress
+			transaction.TokenValue = *values[0].(*big.Int)
+			transaction.TokenType = TokenTypeToken
+		},
+	},
+	// burnFrom(address account, uint256 value)
+	"0x79cc6790": {
+		name:      "burnFrom",
+		arguments: newTokenArguments("address", "uint256"),
+		decode: func(transaction *Transaction, sender string, values []interface{}) {
+			transaction.To = zeroAddress
+			transaction.TokenValue = *values[1].(*big.Int)
+			transaction.Spender = sender
+			transaction.TokenType = TokenTypeToken
+		},
+	},
+}
+
+// isERC721Event tells whether a log of the contract is an ERC-721 Transfer or
+// Approval, whose token id is indexed, or an ERC-20 one. ok is false if the
+// log is none of them.
+func isERC721Event(contract common.Address, log1 *types.Log) (erc721 bool, ok bool) {
+	if log1.Address != contract || len(log1.Topics) == 0 ||
+		log1.Topics[0] != transferEventTopic && log1.Topics[0] != approvalEventTopic {
+		return false, false
+	}
+	switch len(log1.Topics) {
+	case 4:
+		return true, true
+	case 3:
+		return false, true
+	}
+	return false, false
+}
+
+// isERC721Contract tells whether the contract called by a transaction is an
+// ERC-721, from the Transfer and Approval events it emitted in the receipt.
+// Without such an event the contract is asked with ERC-165.
+func (s *TransactionExporter) isERC721Contract(contract common.Address, receipt *types.Receipt, block *types.Block) bool {
+	if s.legacyERC721Tokens[contract] {
+		return true
+	}
+	if receipt != nil {
+		for _, log1 := range receipt.Logs {
+			if erc721, ok := isERC721Event(contract, log1); ok {
+				return erc721
+			}
+		}
+	}
+	if s.tokenMetadata == nil || block == nil {
+		return false
+	}
+	return s.tokenMetadata.SupportsERC721(contract, block)
+}
+
+// decodeTokenCall fills the token info of a top level record whose input
+// calls one of the tokenMethods, erc721 tells whether the called contract is
+// an ERC-721. The contract moves to ContractAddress and To becomes the token
+// receiver, From stays the sender of the transaction. It returns false if the
+// input is not a token call.
+func decodeTokenCall(transaction *Transaction, erc721 bool) bool {
+	if transaction.To == "" || len(transaction.Data) < 10 {
+		return false
+	}
+	input, err := hexutil.Decode(string(transaction.Data))
+	if err != nil || len(input) < 4 {
+		return false
+	}
+	method, ok := tokenMethods[hexutil.Encode(input[:4])]
+	if !ok {
+		return false
+	}
+	decode := method.decode
+	if erc721 {
+		//ERC-721 的 transferFrom 和 approve 与 ERC-20 的方法签名相同
+		if decode = method.decodeERC721; decode == nil {
+			return false
+		}
+	}
+	values, err := method.arguments.UnpackValues(input[4:])
+	if err != nil {
+		log.Debugf("decode %v of %v error %v", method.name, transaction.Hash, err)
+		return false
+	}
+	sender := transaction.From
+	transaction.ContractAddress = transaction.To
+	transaction.MethodName = method.name
+	decode(transaction, sender, values)
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func tokenCallData(t *testing.T, selector string, arguments ...interface{}) []byte {
+	method := tokenMethods[selector]
+	packed, err := method.arguments.Pack(arguments...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(hexutil.Encode(append(hexutil.MustDecode(selector), packed...)))
+}
+
+func TestDecodeTokenCall(t *testing.T) {
+	contract := common.HexToAddress("0x0c").String()
+	sender := common.HexToAddress("0x0a").String()
+	owner := common.HexToAddress("0x0b")
+	receiver := common.HexToAddress("0x0d")
+
+	transaction := &Transaction{From: sender, To: contract, Data: tokenCallData(t, "0x23b872dd", owner, receiver, big.NewInt(100))}
+	if !decodeTokenCall(transaction, false) {
+		t.Fatalf("transferFrom not decoded")
+	}
+	//From 仍然是交易发起者
+	if transaction.MethodName != "transferFrom" || transaction.ContractAddress != contract || transaction.From != sender ||
+		transaction.To != receiver.String() || transaction.Spender != sender || transaction.TokenValue.Int64() != 100 || transaction.TokenType != TokenTypeToken {
+		t.Fatalf("transferFrom got %v", transaction)
+	}
+
+	transaction = &Transaction{From: sender, To: contract, Data: tokenCallData(t, "0x095ea7b3", receiver, big.NewInt(5))}
+	if !decodeTokenCall(transaction, false) || transaction.Spender != receiver.String() || transaction.TokenType != TokenTypeApproval || transaction.From != sender {
+		t.Fatalf("approve got %v", transaction)
+	}
+
+	//参数长度不够
+	transaction = &Transaction{From: sender, To: contract, Data: []byte("0xa9059cbb0000")}
+	if decodeTokenCall(transaction, false) || transaction.ContractAddress != "" {
+		t.Fatalf("short transfer decoded %v", transaction)
+	}
+
+	//ERC-721 的 transferFrom 最后一个参数是 tokenId, approve 不是代币授权
+	transaction = &Transaction{From: sender, To: contract, Data: tokenCallData(t, "0x23b872dd", owner, receiver, big.NewInt(42))}
+	if !decodeTokenCall(transaction, true) || transaction.TokenType != TokenTypeERC721 || transaction.TokenId.Int64() != 42 ||
+		transaction.TokenValue.Int64() != 1 || transaction.From != sender || transaction.To != receiver.String() {
+		t.Fatalf("ERC-721 transferFrom got %v", transaction)
+	}
+	transaction = &Transaction{From: sender, To: contract, Data: tokenCallData(t, "0x095ea7b3", receiver, big.NewInt(42))}
+	if decodeTokenCall(transaction, true) || transaction.TokenType != TokenTypeDefault {
+		t.Fatalf("ERC-721 approve decoded %v", transaction)
+	}
+}
+
+func TestIsERC721Contract(t *testing.T) {
+	contract := common.HexToAddress("0x0c")
+	other := common.HexToAddress("0x0e")
+	from := common.HexToAddress("0x0a")
+	to := common.HexToAddress("0x0b")
+	exporter := &TransactionExporter{}
+	erc721Receipt := &types.Receipt{Logs: []*types.Log{
+		{Address: other, Topics: []common.Hash{transferEventTopic, from.Hash(), to.Hash()}},
+		{Address: contract, Topics: []common.Hash{transferEventTopic, from.Hash(), to.Hash(), common.BigToHash(big.NewInt(42))}},
+	}}
+	if !exporter.isERC721Contract(contract, erc721Receipt, nil) {
+		t.Fatalf("4 topic Transfer is not ERC-721")
+	}
+	if exporter.isERC721Contract(other, erc721Receipt, nil) {
+		t.Fatalf("3 topic Transfer is ERC-721")
+	}
+	//没有事件也没有状态时按 ERC-20 处理, 配置的早期 ERC-721 除外
+	if exporter.isERC721Contract(contract, &types.Receipt{}, nil) {
+		t.Fatalf("contract without events is ERC-721")
+	}
+	exporter.legacyERC721Tokens = map[common.Address]bool{contract: true}
+	if !exporter.isERC721Contract(contract, nil, nil) {
+		t.Fatalf("legacy ERC-721 is not ERC-721")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// keccak256("Transfer(address,address,uint256)"), ERC-20 和 ERC-721 共用
+var transferEventTopic = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+
+// keccak256("Approval(address,address,uint256)"), ERC-721 的 Approval 签名相同但 tokenId 是 indexed
+var approvalEventTopic = common.HexToHash("0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")
+
+// keccak256("Deposit(address,uint256)"), WETH 包装 ETH
+var depositEventTopic = common.HexToHash("0xe1fffcc4923d04b559f4d29a8bfc6cda04eb5b0d3c460751c2402c5c5cc9109c")
+
+// keccak256("Withdrawal(address,uint256)"), WETH 解包 ETH
+var withdrawalEventTopic = common.HexToHash("0x7fcf532c15f0a6db0bd6d0e038bea71d30d808c7d98cb3bf7268a95bf5081b65")
+
+// keccak256("TransferSingle(address,address,address,uint256,uint256)")
+var transferSingleEventTopic = common.HexToHash("0xc3d58168c5ae7397731d063d5bbf3d657854427343f4c083240f7aacaa2d0f62")
+
+// keccak256("TransferBatch(address,address,address,uint256[],uint256[])")
+var transferBatchEventTopic = common.HexToHash("0x4a39dc06d4c0dbc64b70af90fd698a233a518aa5d07e595d983b8c0526c8f7fb")
+
+// TransferBatch 的非 indexed 参数: uint256[] ids, uint256[] values
+var transferBatchArguments = func() abi.Arguments {
+	uint256Array, _ := abi.NewType("uint256[]", "", nil)
+	return abi.Arguments{{Name: "ids", Type: uint256Array}, {Name: "values", Type: uint256Array}}
+}()
+
+// topicAddress returns the address held in an indexed topic or a data word.
+func topicAddress(word []byte) string {
+	return common.BytesToAddress(word).String()
+}
+
+// dataWord returns the i-th 32 byte word of the log data.
+func dataWord(data []byte, i int) []byte {
+	return data[i*32 : (i+1)*32]
+}
+
+// receiptStatus maps the receipt status, where 1 means success, to the
+// TransactionStatus consts.
+func receiptStatus(receipt *types.Receipt) uint64 {
+	if receipt.Status == types.ReceiptStatusSuccessful {
+		return TransactionStatusSuccess
+	}
+	return TransactionStatusFailed
+}
+
+// newTokenEvent returns the record of a token event, based on the top level
+// record of its transaction.
+func newTokenEvent(parentTransaction Transaction, receipt *types.Receipt, log1 *types.Log) Transaction {
+	return Transaction{
+		Timestamp:        parentTransaction.Timestamp,
+		Gas:              *big.NewInt(int64(receipt.CumulativeGasUsed)),
+		GasPrice:         parentTransaction.GasPrice,
+		UsedGas:          *big.NewInt(int64(receipt.GasUsed)),
+		Hash:             parentTransaction.Hash,
+		Nonce:            parentTransaction.Nonce,
+		Status:           receiptStatus(receipt),
+		ContractAddress:  log1.Address.String(),
+		BlockHash:        log1.BlockHash.String(),
+		BlockNumber:      *new(big.Int).SetUint64(log1.BlockNumber),
+		TransactionIndex: *big.NewInt(int64(log1.TxIndex)),
+		LogIndex:         *big.NewInt(int64(log1.Index)),
+		InternalIndex:    InternalIndexDefault,
+	}
+}
+
+// parseTokenEvents decodes the token events of a receipt into records, based
+// on the top level record of the transaction. Mints and burns come out as
+// transfers from or to the zero address, so do the Deposit and Withdrawal
+// events of the wrapped tokens. The other logs are decoded by the ABI files
+// of the event decoder registry, if any matches.
+func (s *TransactionExporter) parseTokenEvents(parentTransaction Transaction, receipt *types.Receipt) []Transaction {
+	var transactionList []Transaction
+	for _, log1 := range receipt.Logs {
+		if len(log1.Topics) <= 0 {
+			continue
+		}
+		//标准事件解析失败时(同一个 topic 的非标准事件)交给 abi 解析
+		handled := false
+		switch log1.Topics[0] {
+		case transferEventTopic:
+			transaction, ok := parseTransferEvent(newTokenEvent(parentTransaction, receipt, log1), log1, s.legacyERC721Tokens[log1.Address])
+			if ok {
+				transactionList = append(transactionList, transaction)
+			}
+			handled = ok
+		case approvalEventTopic:
+			transaction, ok := parseApprovalEvent(newTokenEvent(parentTransaction, receipt, log1), log1)
+			if ok {
+				transactionList = append(transactionList, transaction)
+			}
+			handled = ok
+		case depositEventTopic, withdrawalEventTopic:
+			if !s.wrappedTokens[log1.Address] {
+				break
+			}
+			transaction, ok := parseWrappedTokenEvent(newTokenEvent(parentTransaction, receipt, log1), log1)
+			if ok {
+				transactionList = append(transactionList, transaction)
+			}
+			handled = ok
+		case transferSingleEventTopic, transferBatchEventTopic:
+			erc1155List := parseERC1155TransferEvent(newTokenEvent(parentTransaction, receipt, log1), log1)
+			transactionList = append(transactionList, erc1155List...)
+			handled = len(erc1155List) > 0
+		}
+		if handled || s.eventDecoders == nil {
+			continue
+		}
+		if transaction, ok := s.eventDecoders.Decode(newTokenEvent(parentTransaction, receipt, log1), log1); ok {
+			transactionList = append(transactionList, transaction)
+		}
+	}
+	return transactionList
+}
+
+// parseTransferEvent decodes an ERC-20 or ERC-721 Transfer event, they only
+// differ in whether the last argument is indexed. legacyERC721 tells that the
+// contract is an early ERC-721 without indexed arguments, whose events look
+// like the ones of the early ERC-20s.
+func parseTransferEvent(transaction Transaction, log1 *types.Log, legacyERC721 bool) (Transaction, bool) {
+	switch {
+	case len(log1.Topics) == 3 && len(log1.Data) >= 32:
+		// ERC-20 Transfer(address indexed from, address indexed to, uint256 value)
+		transaction.From = topicAddress(log1.Topics[1].Bytes())
+		transaction.To = topicAddress(log1.Topics[2].Bytes())
+		transaction.TokenValue.SetBytes(dataWord(log1.Data, 0))
+		transaction.TokenType = TokenTypeToken
+	case len(log1.Topics) == 4:
+		// ERC-721 Transfer(address indexed from, address indexed to, uint256 indexed tokenId)
+		transaction.From = topicAddress(log1.Topics[1].Bytes())
+		transaction.To = topicAddress(log1.Topics[2].Bytes())
+		transaction.TokenId.SetBytes(log1.Topics[3].Bytes())
+		transaction.TokenValue.SetUint64(1)
+		transaction.TokenType = TokenTypeERC721
+	case legacyERC721 && len(log1.Topics) == 1 && len(log1.Data) == 96:
+		// 早期的 ERC-721 (例如 CryptoKitties) 参数都不是 indexed, 早期的 ERC-20 也有这样的事件, 只解析配置的合约
+		transaction.From = topicAddress(dataWord(log1.Data, 0))
+		transaction.To = topicAddress(dataWord(log1.Data, 1))
+		transaction.TokenId.SetBytes(dataWord(log1.Data, 2))
+		transaction.TokenValue.SetUint64(1)
+		transaction.TokenType = TokenTypeERC721
+	default:
+		return transaction, false
+	}
+	return transaction, true
+}
+
+// parseApprovalEvent decodes an ERC-20 Approval event, To is the spender as in
+// the records of approve calls.
+func parseApprovalEvent(transaction Transaction, log1 *types.Log) (Transaction, bool) {
+	// Approval(address indexed owner, address indexed spender, uint256 value)
+	if len(log1.Topics) != 3 || len(log1.Data) < 32 {
+		return transaction, false
+	}
+	transaction.From = topicAddress(log1.Topics[1].Bytes())
+	transaction.Spender = topicAddress(log1.Topics[2].Bytes())
+	transaction.To = transaction.Spender
+	transaction.TokenValue.SetBytes(dataWord(log1.Data, 0))
+	transaction.TokenType = TokenTypeApproval
+	return transaction, true
+}
+
+// parseWrappedTokenEvent decodes a Deposit as a mint to the depositor and a
+// Withdrawal as a burn from the withdrawer.
+func parseWrappedTokenEvent(transaction Transaction, log1 *types.Log) (Transaction, bool) {
+	// Deposit(address indexed dst, uint wad)
+	// Withdrawal(address indexed src, uint wad)
+	if len(log1.Topics) != 2 || len(log1.Data) < 32 {
+		return transaction, false
+	}
+	if log1.Topics[0] == depositEventTopic {
+		transaction.From = zeroAddress
+		transaction.To = topicAddress(log1.Topics[1].Bytes())
+	} else {
+		transaction.From = topicAddress(log1.Topics[1].Bytes())
+		transaction.To = zeroAddress
+	}
+	transaction.TokenValue.SetBytes(dataWord(log1.Data, 0))
+	transaction.TokenType = TokenTypeToken
+	return transaction, true
+}
+
+// linkWrappedTokenEvents ties every wrapped token mint and burn of a
+// transaction to the ETH transfer that paid for it: for a mint the first
+// successful transfer of the same value into the contract, for a burn the
+// first one out of it, in internal index order.
+func linkWrappedTokenEvents(transactionList []Transaction, wrappedTokens map[common.Address]bool) {
+	var ethTransferList []*Transaction
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		if transaction.LogIndex.Sign() < 0 && transaction.Value.Sign() > 0 && transaction.Status == TransactionStatusSuccess {
+			ethTransferList = append(ethTransferList, transaction)
+		}
+	}
+	sort.SliceStable(ethTransferList, func(i, j int) bool {
+		return compareInternalIndex(ethTransferList[i].InternalIndex, ethTransferList[j].InternalIndex) < 0
+	})
+	linked := map[*Transaction]bool{}
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		if transaction.LogIndex.Sign() < 0 || transaction.TokenType != TokenTypeToken ||
+			!wrappedTokens[common.HexToAddress(transaction.ContractAddress)] {
+			continue
+		}
+		mint := transaction.From == zeroAddress
+		for _, ethTransfer := range ethTransferList {
+			if linked[ethTransfer] || ethTransfer.Value.Cmp(&transaction.TokenValue) != 0 {
+				continue
+			}
+			if mint && normalizeAddress(ethTransfer.To) != transaction.ContractAddress ||
+				!mint && normalizeAddress(ethTransfer.From) != transaction.ContractAddress {
+				continue
+			}
+			linked[ethTransfer] = true
+			transaction.RelatedInternalIndex = ethTransfer.InternalIndex
+			break
+		}
+	}
+}
+
+// parseERC1155TransferEvent decodes a TransferSingle or TransferBatch event
+// into one record per (id, value) pair, numbered by SubIndex in the order of
+// the event arrays.
+func parseERC1155TransferEvent(transaction Transaction, log1 *types.Log) []Transaction {
+	if len(log1.Topics) != 4 {
+		return nil
+	}
+	// TransferSingle(address indexed operator, address indexed from, address indexed to, uint256 id, uint256 value)
+	// TransferBatch(address indexed operator, address indexed from, address indexed to, uint256[] ids, uint256[] values)
+	transaction.Operator = topicAddress(log1.Topics[1].Bytes())
+	transaction.From = topicAddress(log1.Topics[2].Bytes())
+	transaction.To = topicAddress(log1.Topics[3].Bytes())
+	transaction.TokenType = TokenTypeERC1155
+
+	var idList, valueList []*big.Int
+	if log1.Topics[0] == transferSingleEventTopic {
+		if len(log1.Data) != 64 {
+			return nil
+		}
+		idList = []*big.Int{new(big.Int).SetBytes(dataWord(log1.Data, 0))}
+		valueList = []*big.Int{new(big.Int).SetBytes(dataWord(log1.Data, 1))}
+	} else {
+		values, err := transferBatchArguments.UnpackValues(log1.Data)
+		if err != nil {
+			log.Errorf("unpack TransferBatch of %v log %v error %v", transaction.Hash, log1.Index, err)
+			return nil
+		}
+		idList, valueList = values[0].([]*big.Int), values[1].([]*big.Int)
+		if len(idList) != len(valueList) {
+			log.Errorf("TransferBatch of %v log %v has %v ids and %v values", transaction.Hash, log1.Index, len(idList), len(valueList))
+			return nil
+		}
+	}
+	transactionList := make([]Transaction, len(idList))
+	for i := range idList {
+		transactionList[i] = transaction
+		transactionList[i].TokenId = *idList[i]
+		transactionList[i].TokenValue = *valueList[i]
+		transactionList[i].SubIndex = uint64(i)
+	}
+	return transactionList
+}
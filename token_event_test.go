@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestParseTransferEvents(t *testing.T) {
+	from := common.HexToAddress("0x75186ece18d7051afb9c1aee85170c0deda23d82")
+	to := common.HexToAddress("0xf3fd2fc2387141550a4769173bf3802f0eaad992")
+	receipt := &types.Receipt{
+		Status: types.ReceiptStatusSuccessful,
+		Logs: []*types.Log{
+			{
+				Topics: []common.Hash{transferEventTopic, from.Hash(), to.Hash()},
+				Data:   common.BigToHash(big.NewInt(1000)).Bytes(),
+				Index:  0,
+			},
+			{
+				//ERC-721 mint
+				Topics: []common.Hash{transferEventTopic, {}, to.Hash(), common.BigToHash(big.NewInt(42))},
+				Index:  1,
+			},
+			{
+				Topics: []common.Hash{common.HexToHash("0x01")},
+				Index:  2,
+			},
+		},
+	}
+	transactionList := (&TransactionExporter{}).parseTokenEvents(Transaction{Hash: "0xaa"}, receipt)
+	if len(transactionList) != 2 {
+		t.Fatalf("got %v records, want 2", len(transactionList))
+	}
+	erc20 := transactionList[0]
+	if erc20.Status != TransactionStatusSuccess {
+		t.Fatalf("status got %v", erc20.Status)
+	}
+	if erc20.TokenType != TokenTypeToken || erc20.From != from.String() || erc20.To != to.String() || erc20.TokenValue.Int64() != 1000 {
+		t.Fatalf("erc20 got %v", erc20)
+	}
+	erc721 := transactionList[1]
+	if erc721.TokenType != TokenTypeERC721 || erc721.From != (common.Address{}).String() || erc721.TokenId.Int64() != 42 || erc721.LogIndex.Int64() != 1 {
+		t.Fatalf("erc721 got %v", erc721)
+	}
+}
+
+func TestParseLegacyERC721TransferEvent(t *testing.T) {
+	kitty := common.HexToAddress("0x06012c8cf97BEaD5deAe237070F9587f8E7A266d")
+	token := common.HexToAddress("0x0c")
+	from := common.HexToAddress("0x0a")
+	to := common.HexToAddress("0x0b")
+	//参数都不是 indexed 的 Transfer(address,address,uint256)
+	data := append(append(from.Hash().Bytes(), to.Hash().Bytes()...), common.BigToHash(big.NewInt(42)).Bytes()...)
+	receipt := &types.Receipt{
+		Logs: []*types.Log{
+			{Address: kitty, Topics: []common.Hash{transferEventTopic}, Data: data, Index: 0},
+			{Address: token, Topics: []common.Hash{transferEventTopic}, Data: data, Index: 1},
+		},
+	}
+	exporter := &TransactionExporter{legacyERC721Tokens: map[common.Address]bool{kitty: true}}
+	transactionList := exporter.parseTokenEvents(Transaction{Hash: "0xaa"}, receipt)
+	if len(transactionList) != 1 {
+		t.Fatalf("got %v records, want 1", len(transactionList))
+	}
+	if erc721 := transactionList[0]; erc721.TokenType != TokenTypeERC721 || erc721.From != from.String() || erc721.To != to.String() || erc721.TokenId.Int64() != 42 {
+		t.Fatalf("erc721 got %v", erc721)
+	}
+}
+
+func TestParseERC1155TransferEvents(t *testing.T) {
+	if transferSingleEventTopic != crypto.Keccak256Hash([]byte("TransferSingle(address,address,address,uint256,uint256)")) ||
+		transferBatchEventTopic != crypto.Keccak256Hash([]byte("TransferBatch(address,address,address,uint256[],uint256[])")) {
+		t.Fatalf("wrong ERC-1155 event topic")
+	}
+	operator := common.HexToAddress("0x01")
+	from := common.HexToAddress("0x02")
+	to := common.HexToAddress("0x03")
+	batchData, err := transferBatchArguments.Pack([]*big.Int{big.NewInt(7), big.NewInt(8)}, []*big.Int{big.NewInt(70), big.NewInt(80)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt := &types.Receipt{
+		Logs: []*types.Log{
+			{
+				Topics: []common.Hash{transferSingleEventTopic, operator.Hash(), from.Hash(), to.Hash()},
+				Data:   append(common.BigToHash(big.NewInt(5)).Bytes(), common.BigToHash(big.NewInt(50)).Bytes()...),
+				Index:  0,
+			},
+			{
+				Topics: []common.Hash{transferBatchEventTopic, operator.Hash(), from.Hash(), to.Hash()},
+				Data:   batchData,
+				Index:  1,
+			},
+		},
+	}
+	transactionList := (&TransactionExporter{}).parseTokenEvents(Transaction{Hash: "0xaa"}, receipt)
+	if len(transactionList) != 3 {
+		t.Fatalf("got %v records, want 3", len(transactionList))
+	}
+	for i, want := range []struct{ id, value, logIndex, subIndex int64 }{{5, 50, 0, 0}, {7, 70, 1, 0}, {8, 80, 1, 1}} {
+		transaction := transactionList[i]
+		if transaction.TokenType != TokenTypeERC1155 || transaction.Operator != operator.String() || transaction.From != from.String() || transaction.To != to.String() {
+			t.Fatalf("record %v got %v", i, transaction)
+		}
+		if transaction.TokenId.Int64() != want.id || transaction.TokenValue.Int64() != want.value ||
+			transaction.LogIndex.Int64() != want.logIndex || int64(transaction.SubIndex) != want.subIndex {
+			t.Fatalf("record %v got %v", i, transaction)
+		}
+	}
+}
+
+func TestParseApprovalEvent(t *testing.T) {
+	if approvalEventTopic != crypto.Keccak256Hash([]byte("Approval(address,address,uint256)")) {
+		t.Fatalf("wrong Approval event topic")
+	}
+	owner := common.HexToAddress("0x0a")
+	spender := common.HexToAddress("0x0b")
+	receipt := &types.Receipt{
+		Logs: []*types.Log{
+			{
+				Topics: []common.Hash{approvalEventTopic, owner.Hash(), spender.Hash()},
+				Data:   common.BigToHash(big.NewInt(9)).Bytes(),
+			},
+			{
+				//ERC-721 Approval
+				Topics: []common.Hash{approvalEventTopic, owner.Hash(), spender.Hash(), common.BigToHash(big.NewInt(1))},
+			},
+		},
+	}
+	transactionList := (&TransactionExporter{}).parseTokenEvents(Transaction{}, receipt)
+	if len(transactionList) != 1 {
+		t.Fatalf("got %v records, want 1", len(transactionList))
+	}
+	if approval := transactionList[0]; approval.TokenType != TokenTypeApproval || approval.From != owner.String() ||
+		approval.Spender != spender.String() || approval.TokenValue.Int64() != 9 || !isApprovalEvent(&approval) {
+		t.Fatalf("approval got %v", approval)
+	}
+}
+
+func TestWrappedTokenEvents(t *testing.T) {
+	if depositEventTopic != crypto.Keccak256Hash([]byte("Deposit(address,uint256)")) ||
+		withdrawalEventTopic != crypto.Keccak256Hash([]byte("Withdrawal(address,uint256)")) {
+		t.Fatalf("wrong WETH event topic")
+	}
+	weth := common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2")
+	router := common.HexToAddress("0x0a")
+	wrappedTokens := map[common.Address]bool{weth: true}
+	wad := common.BigToHash(big.NewInt(100)).Bytes()
+	receipt := &types.Receipt{
+		Logs: []*types.Log{
+			{Address: weth, Topics: []common.Hash{depositEventTopic, router.Hash()}, Data: wad, Index: 0},
+			{Address: weth, Topics: []common.Hash{withdrawalEventTopic, router.Hash()}, Data: wad, Index: 1},
+			//没有配置的合约
+			{Address: router, Topics: []common.Hash{depositEventTopic, router.Hash()}, Data: wad, Index: 2},
+		},
+	}
+	transactionList := (&TransactionExporter{wrappedTokens: wrappedTokens}).parseTokenEvents(Transaction{}, receipt)
+	if len(transactionList) != 2 {
+		t.Fatalf("got %v records, want 2", len(transactionList))
+	}
+	//trace 中的地址是小写的
+	transactionList = append(transactionList,
+		Transaction{LogIndex: *LogIndexDefault, InternalIndex: "0_0", From: strings.ToLower(router.String()), To: strings.ToLower(weth.String()), Value: *big.NewInt(100)},
+		Transaction{LogIndex: *LogIndexDefault, InternalIndex: "0_1", From: strings.ToLower(weth.String()), To: strings.ToLower(router.String()), Value: *big.NewInt(100)},
+		Transaction{LogIndex: *LogIndexDefault, InternalIndex: InternalIndexDefault, To: router.String()},
+	)
+	linkWrappedTokenEvents(transactionList, wrappedTokens)
+	deposit, withdrawal := transactionList[0], transactionList[1]
+	if deposit.From != zeroAddress || deposit.To != router.String() || deposit.RelatedInternalIndex != "0_0" {
+		t.Fatalf("deposit got %v", deposit)
+	}
+	if withdrawal.From != router.String() || withdrawal.To != zeroAddress || withdrawal.RelatedInternalIndex != "0_1" {
+		t.Fatalf("withdrawal got %v", withdrawal)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var tokenMetadataPrefix = []byte("tokenMetadata-")
+
+var (
+	nameSelector      = hexutil.MustDecode("0x06fdde03") // name()
+	symbolSelector    = hexutil.MustDecode("0x95d89b41") // symbol()
+	decimalsSelector  = hexutil.MustDecode("0x313ce567") // decimals()
+	allowanceSelector = hexutil.MustDecode("0xdd62ed3e") // allowance(address,address)
+	// supportsInterface(bytes4) 查询 ERC-721 的 interface id 0x80ac58cd
+	supportsERC721Data = hexutil.MustDecode("0x01ffc9a780ac58cd00000000000000000000000000000000000000000000000000000000")
+)
+
+var stringArguments = newTokenArguments("string")
+
+// 只读调用的gas上限和超时
+const tokenMetadataCallGas uint64 = 1000000
+const tokenMetadataCallTimeout = 5 * time.Second
+
+// 元数据不完整或查询超时的代币隔多少个区块再查
+const tokenMetadataRetryBlocks uint64 = 1000
+
+// TokenMetadata is what a token contract returns for name(), symbol() and
+// decimals(). Decimals is nil when the contract has no decimals().
+type TokenMetadata struct {
+	Name     string  `json:"name"`
+	Symbol   string  `json:"symbol"`
+	Decimals *uint64 `json:"decimals"`
+}
+
+// complete tells whether name() or symbol() returned a value, NFTs have no
+// decimals(). A proxy looked up before its initialisation returns nothing, so
+// only complete metadata is cached.
+func (s *TokenMetadata) complete() bool {
+	return s.Name != "" || s.Symbol != ""
+}
+
+// isTokenRecord tells whether a record is a token transfer or approval, the
+// records whose contract is known to be a token.
+func isTokenRecord(transaction *Transaction) bool {
+	return transaction.TokenType >= TokenTypeToken && transaction.TokenType <= TokenTypeApproval
+}
+
+// TokenMetadataResolver calls the read-only metadata methods of the token
+// contracts against the local state and caches the complete results in
+// memory and, if a database is given, in the database.
+type TokenMetadataResolver struct {
+	chain  *core.BlockChain
+	db     ethdb.Database
+	lock   sync.Mutex
+	cache  map[common.Address]*TokenMetadata
+	erc721 map[common.Address]bool // ERC-165 查询的结果
+	// 不完整的结果只缓存在内存里, 相差 tokenMetadataRetryBlocks 个区块以内直接使用
+	incomplete map[common.Address]*incompleteTokenMetadata
+}
+
+type incompleteTokenMetadata struct {
+	metadata    *TokenMetadata
+	blockNumber uint64 // 查询的区块
+}
+
+func NewTokenMetadataResolver(chain *core.BlockChain, db ethdb.Database) *TokenMetadataResolver {
+	return &TokenMetadataResolver{
+		chain:  chain,
+		db:     db,
+		cache:  map[common.Address]*TokenMetadata{},
+		erc721: map[common.Address]bool{},
+
+		incomplete: map[common.Address]*incompleteTokenMetadata{},
+	}
+}
+
+func tokenMetadataKey(address common.Address) []byte {
+	return []byte(fmt.Sprintf("%s%s", tokenMetadataPrefix, address.String()))
+}
+
+func (s *TokenMetadataResolver) get(address common.Address) (*TokenMetadata, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if metadata, ok := s.cache[address]; ok {
+		return metadata, true
+	}
+	if s.db == nil {
+		return nil, false
+	}
+	data, err := s.db.Get(tokenMetadataKey(address))
+	if err != nil {
+		return nil, false
+	}
+	metadata := &TokenMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		log.Errorf("unmarshal token metadata of %v error %v", address.String(), err)
+		return nil, false
+	}
+	s.cache[address] = metadata
+	return metadata, true
+}
+
+func (s *TokenMetadataResolver) put(address common.Address, metadata *TokenMetadata) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cache[address] = metadata
+	if s.db == nil {
+		return
+	}
+	marshal, err := json.Marshal(metadata)
+	if err != nil {
+		return
+	}
+	if err := s.db.Put(tokenMetadataKey(address), marshal); err != nil {
+		log.Errorf("put token metadata of %v error %v", address.String(), err)
+	}
+}
+
+// getIncomplete returns the incomplete metadata of a token resolved near the
+// given block.
+func (s *TokenMetadataResolver) getIncomplete(address common.Address, number uint64) (*TokenMetadata, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	incomplete, ok := s.incomplete[address]
+	if !ok {
+		return nil, false
+	}
+	//迁移时的区块可能早于查询的区块
+	if number+tokenMetadataRetryBlocks <= incomplete.blockNumber || number >= incomplete.blockNumber+tokenMetadataRetryBlocks {
+		return nil, false
+	}
+	return incomplete.metadata, true
+}
+
+func (s *TokenMetadataResolver) putIncomplete(address common.Address, number uint64, metadata *TokenMetadata) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.incomplete[address] = &incompleteTokenMetadata{metadata: metadata, blockNumber: number}
+}
+
+// Resolve returns the metadata of a token, calling the contract at the state
+// after the given block if it is not cached. Incomplete metadata is cached in
+// memory for tokenMetadataRetryBlocks blocks. It returns nil if the state of
+// the block is not available.
+func (s *TokenMetadataResolver) Resolve(address common.Address, block *types.Block) *TokenMetadata {
+	if metadata, ok := s.get(address); ok {
+		return metadata
+	}
+	if metadata, ok := s.getIncomplete(address, block.NumberU64()); ok {
+		return metadata
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenMetadataCallTimeout)
+	defer cancel()
+	stateDB, header, err := s.stateAt(block.Hash())
+	if err != nil {
+		log.Debugf("state of block %v not available to resolve token %v, error %v", block.Number().Uint64(), address.String(), err)
+		return nil
+	}
+	metadata := &TokenMetadata{}
+	if ret, ok := s.call(ctx, stateDB, header, address, nameSelector); ok {
+		metadata.Name = decodeTokenString(ret)
+	}
+	if ret, ok := s.call(ctx, stateDB, header, address, symbolSelector); ok {
+		metadata.Symbol = decodeTokenString(ret)
+	}
+	if ret, ok := s.call(ctx, stateDB, header, address, decimalsSelector); ok && len(ret) >= 32 {
+		if decimals := new(big.Int).SetBytes(ret[:32]); decimals.IsUint64() && decimals.Uint64() <= math.MaxUint8 {
+			value := decimals.Uint64()
+			metadata.Decimals = &value
+		}
+	}
+	if ctx.Err() != nil {
+		//超时的结果不完整, 隔一段区块再查
+		log.Warnf("resolve token %v at block %v timeout", address.String(), block.Number().Uint64())
+		s.putIncomplete(address, block.NumberU64(), metadata)
+		return metadata
+	}
+	if !metadata.complete() {
+		//调用失败或者返回为空, 隔一段区块再查
+		log.Debugf("token %v at block %v has incomplete metadata %+v", address.String(), block.Number().Uint64(), metadata)
+		s.putIncomplete(address, block.NumberU64(), metadata)
+		return metadata
+	}
+	s.put(address, metadata)
+	return metadata
+}
+
+// SupportsERC721 tells whether a contract declares the ERC-721 interface with
+// ERC-165 at the state after the given block. The answers of the contracts
+// that could be called are cached in memory.
+func (s *TokenMetadataResolver) SupportsERC721(address common.Address, block *types.Block) bool {
+	s.lock.Lock()
+	erc721, ok := s.erc721[address]
+	s.lock.Unlock()
+	if ok {
+		return erc721
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenMetadataCallTimeout)
+	defer cancel()
+	stateDB, header, err := s.stateAt(block.Hash())
+	if err != nil {
+		log.Debugf("state of block %v not available to check ERC-721 %v, error %v", block.Number().Uint64(), address.String(), err)
+		return false
+	}
+	if stateDB.GetCodeSize(address) == 0 {
+		//还没有部署的合约之后再查
+		return false
+	}
+	ret, ok := s.call(ctx, stateDB, header, address, supportsERC721Data)
+	if ctx.Err() != nil {
+		return false
+	}
+	//没有 supportsInterface 的合约不是 ERC-721
+	erc721 = ok && len(ret) >= 32 && new(big.Int).SetBytes(ret[:32]).Sign() != 0
+	s.lock.Lock()
+	s.erc721[address] = erc721
+	s.lock.Unlock()
+	return erc721
+}
+
+// Allowance calls allowance(owner, spender) of a token at the state after the
+// given block, false if the state is not available or the call failed.
+func (s *TokenMetadataResolver) Allowance(token common.Address, owner common.Address, spender common.Address, blockHash common.Hash) (*big.Int, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenMetadataCallTimeout)
+	defer cancel()
+	stateDB, header, err := s.stateAt(blockHash)
+	if err != nil {
+		log.Debugf("state of block %v not available to read allowance of %v, error %v", blockHash.String(), token.String(), err)
+		return nil, false
+	}
+	data := append(append(append([]byte{}, allowanceSelector...), owner.Hash().Bytes()...), spender.Hash().Bytes()...)
+	ret, ok := s.call(ctx, stateDB, header, token, data)
+	if !ok || len(ret) < 32 || ctx.Err() != nil {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(ret[:32]), true
+}
+
+// stateAt returns the state after a block and its header.
+func (s *TokenMetadataResolver) stateAt(blockHash common.Hash) (*state.StateDB, *types.Header, error) {
+	header := s.chain.GetHeaderByHash(blockHash)
+	if header == nil {
+		return nil, nil, fmt.Errorf("header %v not found", blockHash.String())
+	}
+	stateDB, err := s.chain.StateAt(header.Root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stateDB, header, nil
+}
+
+// call runs a read-only call of the contract and returns its output, false if
+// it reverted or failed.
+func (s *TokenMetadataResolver) call(ctx context.Context, stateDB *state.StateDB, header *types.Header, address common.Address, data []byte) ([]byte, bool) {
+	msg := types.NewMessage(common.Address{}, &address, 0, new(big.Int), tokenMetadataCallGas, new(big.Int), data, false)
+	evm := vm.NewEVM(core.NewEVMContext(msg, header, s.chain, nil), stateDB, s.chain.Config(), vm.Config{})
+	go func() {
+		<-ctx.Done()
+		evm.Cancel()
+	}()
+	result, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(math.MaxUint64))
+	if err != nil || result.Failed() {
+		return nil, false
+	}
+	return result.Return(), true
+}
+
+// decodeTokenString decodes the output of name() or symbol(), which is an ABI
+// string, or a bytes32 padded with zeros for legacy tokens such as MKR.
+func decodeTokenString(ret []byte) string {
+	if len(ret) == 32 {
+		return sanitizeTokenString(string(bytes.TrimRight(ret, "\x00")))
+	}
+	values, err := stringArguments.UnpackValues(ret)
+	if err != nil || len(values) == 0 {
+		return ""
+	}
+	return sanitizeTokenString(values[0].(string))
+}
+
+func sanitizeTokenString(value string) string {
+	if !utf8.ValidString(value) {
+		return ""
+	}
+	return strings.TrimSpace(strings.Replace(value, "\x00", "", -1))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDecodeTokenString(t *testing.T) {
+	packed, err := stringArguments.Pack("Tether USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if symbol := decodeTokenString(packed); symbol != "Tether USD" {
+		t.Fatalf("string got %q", symbol)
+	}
+	//MKR 之类的旧代币返回 bytes32
+	if symbol := decodeTokenString(common.RightPadBytes([]byte("MKR"), 32)); symbol != "MKR" {
+		t.Fatalf("bytes32 got %q", symbol)
+	}
+	if symbol := decodeTokenString([]byte{0xff, 0xfe}); symbol != "" {
+		t.Fatalf("invalid got %q", symbol)
+	}
+}
+
+func TestTokenMetadataComplete(t *testing.T) {
+	decimals := uint64(18)
+	if (&TokenMetadata{Decimals: &decimals}).complete() || !(&TokenMetadata{Symbol: "CK"}).complete() {
+		t.Fatalf("only metadata with a name or a symbol is complete")
+	}
+	for tokenType, want := range map[uint64]bool{
+		TokenTypeDefault: false, TokenTypeToken: true, TokenTypeERC721: true, TokenTypeERC1155: true,
+		TokenTypeApproval: true, TokenTypeEvent: false, TokenTypeContractCreation: false,
+	} {
+		if got := isTokenRecord(&Transaction{TokenType: tokenType}); got != want {
+			t.Fatalf("token type %v got %v", tokenType, got)
+		}
+	}
+}
+
+func TestTokenMetadataIncomplete(t *testing.T) {
+	resolver := NewTokenMetadataResolver(nil, nil)
+	token := common.HexToAddress("0x0a")
+	resolver.putIncomplete(token, 5000, &TokenMetadata{})
+	//相差 tokenMetadataRetryBlocks 个区块以内不再查询
+	for number, want := range map[uint64]bool{5000: true, 5999: true, 6000: false, 4001: true, 4000: false} {
+		if _, ok := resolver.getIncomplete(token, number); ok != want {
+			t.Fatalf("block %v got %v", number, ok)
+		}
+	}
+	if _, ok := resolver.get(token); ok {
+		t.Fatalf("incomplete metadata is cached as complete")
+	}
+}
@@ -3,33 +3,104 @@ package main
 import (
 	"encoding/json"
 	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 type Transaction struct {
-	Timestamp        big.Int `json:"timestamp"`         // 交易时间
-	BlockNumber      big.Int `json:"block_number"`      // 区块号
-	TokenValue       big.Int `json:"token_value"`       // 代币数量
-	Gas              big.Int `json:"gas"`               // gas
-	GasPrice         big.Int `json:"gas_price"`         // gas price
-	UsedGas          big.Int `json:"used_gas"`          // used gas
-	Value            big.Int `json:"value"`             // eth number
-	Hash             string  `json:"hash"`              // tx id
-	Nonce            uint64  `json:"nonce"`             // tx nonce
-	BlockHash        string  `json:"block_hash"`        // tx blockHash
-	TransactionIndex big.Int `json:"transaction_index"` // tx idx in block
-	LogIndex         big.Int `json:"log_index"`
-	InternalIndex    string  `json:"internal_index"` //字符串处理，　默认是空, 第一层0, 第二层0_0,
-	OpCode           string  `json:"op_code"`
-	From             string  `json:"from"`             // 发起者
-	To               string  `json:"to"`               // 接受者
-	ContractAddress  string  `json:"contract_address"` //  合约地址
-	TokenType        uint64  `json:"token_type"`       // 类型 1 表示是代币 0 表示Eth
-	Data             []byte  `json:"data"`
-	Err              string  `json:"err"`    //如果出错　显示错误信息
-	Status           uint64  `json:"status"` //1 (success) or 0 (failure) or 2(pending), 99未知
+	Timestamp            big.Int           `json:"timestamp"`         // 交易时间
+	BlockNumber          big.Int           `json:"block_number"`      // 区块号
+	TokenValue           big.Int           `json:"token_value"`       // 代币数量
+	Gas                  big.Int           `json:"gas"`               // gas
+	GasPrice             big.Int           `json:"gas_price"`         // gas price
+	UsedGas              big.Int           `json:"used_gas"`          // used gas
+	Value                big.Int           `json:"value"`             // eth number
+	Hash                 string            `json:"hash"`              // tx id
+	Nonce                uint64            `json:"nonce"`             // tx nonce
+	BlockHash            string            `json:"block_hash"`        // tx blockHash
+	TransactionIndex     big.Int           `json:"transaction_index"` // tx idx in block
+	LogIndex             big.Int           `json:"log_index"`
+	InternalIndex        string            `json:"internal_index"` //字符串处理，　默认是空, 第一层0, 第二层0_0,
+	OpCode               string            `json:"op_code"`
+	From                 string            `json:"from"`                   // 发起者
+	To                   string            `json:"to"`                     // 接受者
+	ContractAddress      string            `json:"contract_address"`       //  合约地址
+	TokenType            uint64            `json:"token_type"`             // 类型 1 表示是代币 0 表示Eth 2 表示ERC-721 3 表示ERC-1155 4 表示授权 5 表示abi解析的事件 6 表示合约创建
+	TokenId              big.Int           `json:"token_id"`               // ERC-721 和 ERC-1155 的 tokenId
+	Operator             string            `json:"operator"`               // ERC-1155 的 operator
+	SubIndex             uint64            `json:"sub_index"`              // 同一个日志拆出的多条记录的序号, 例如 TransferBatch 的第几个 id, 合约创建记录为1
+	Spender              string            `json:"spender"`                // 被授权使用代币的地址, approve 的 spender 或者 transferFrom 的调用者
+	MethodName           string            `json:"method_name"`            // 解析出的合约方法名, 例如 transferFrom
+	MethodId             string            `json:"method_id"`              // 调用数据的前4字节, 例如 0xa9059cbb
+	MethodArgs           []string          `json:"method_args"`            // 按签名解析出的参数, 地址为checksum格式, 整数为十进制
+	RelatedInternalIndex string            `json:"related_internal_index"` // WETH Deposit/Withdrawal 对应的 ETH 转账的 internal index
+	CodeHash             string            `json:"code_hash"`              // 创建的合约代码的 keccak256
+	CallPath             []string          `json:"call_path"`              // 合约创建记录中从交易发起者到创建者的调用路径
+	Depth                uint64            `json:"depth"`                  // 调用深度, 交易本身为0, 第一层内部调用为1
+	ParentInternalIndex  string            `json:"parent_internal_index"`  // 最近一层导出的上层调用的 internal index
+	Output               string            `json:"output"`                 // 内部调用的返回数据
+	TokenSymbol          string            `json:"token_symbol"`           // 代币合约 symbol() 的返回
+	TokenDecimals        *uint64           `json:"token_decimals"`         // 代币合约 decimals() 的返回, 没有这个方法时为null
+	EventName            string            `json:"event_name"`             // abi 目录中解析出的事件名
+	EventArgs            map[string]string `json:"event_args"`             // 事件参数, 地址为checksum格式, 整数为十进制
+	CallTree             *CallTreeNode     `json:"call_tree,omitempty"`    // 交易的调用树, 只在交易本身的记录上, 用于 tree 格式
+	Receipt              *types.Receipt    `json:"receipt,omitempty"`      // 交易的receipt, 只在交易本身的记录上, 用于 tree 格式
+	Data                 []byte            `json:"data"`
+	Err                  string            `json:"err"`     //如果出错　显示错误信息
+	Status               uint64            `json:"status"`  //0 (success) or 1 (failure) or 2(pending) or 3(trace timeout)
+	Removed              bool              `json:"removed"` //所在区块被回滚, 需要删除之前导出的记录
+	Stream               string            `json:"stream"`  //confirmed 已确认, unsafe 未达到确认数可能被回滚, pending 未打包
 }
 
 func (s Transaction) String() string {
 	marshal, _ := json.Marshal(s)
 	return string(marshal)
 }
+
+// SortTransactionList orders the records of a block by transaction index,
+// then internal index, then log index and sub index.
+func SortTransactionList(transactionList []Transaction) {
+	sort.SliceStable(transactionList, func(i, j int) bool {
+		a, b := &transactionList[i], &transactionList[j]
+		if c := a.TransactionIndex.Cmp(&b.TransactionIndex); c != 0 {
+			return c < 0
+		}
+		if c := compareInternalIndex(a.InternalIndex, b.InternalIndex); c != 0 {
+			return c < 0
+		}
+		if c := a.LogIndex.Cmp(&b.LogIndex); c != 0 {
+			return c < 0
+		}
+		return a.SubIndex < b.SubIndex
+	})
+}
+
+// compareInternalIndex compares internal indexes like 0_1_10 level by level,
+// a frame sorts before its children.
+func compareInternalIndex(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	aList := strings.Split(a, "_")
+	bList := strings.Split(b, "_")
+	for i := 0; i < len(aList) && i < len(bList); i++ {
+		x, errX := strconv.ParseUint(aList[i], 10, 64)
+		y, errY := strconv.ParseUint(bList[i], 10, 64)
+		if errX != nil || errY != nil {
+			if c := strings.Compare(aList[i], bList[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(aList) - len(bList)
+}
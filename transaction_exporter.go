@@ -1,76 +1,141 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/Jeffail/gabs"
 	log "github.com/cihub/seelog"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/core/vm"
-	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
 	"math"
 	"math/big"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 type TransactionExporter struct {
-	appConfig       *AppConfig
-	chainConfig     *params.ChainConfig
-	ethereum        *eth.Ethereum
-	traceConfig     *eth.TraceConfig
-	privateDebugAPI *eth.PrivateDebugAPI
-	saver           Saver
+	appConfig          *AppConfig
+	chainConfig        *params.ChainConfig
+	chain              *core.BlockChain
+	tracer             *TransactionTracer
+	saver              Saver
+	wrappedTokens      map[common.Address]bool
+	legacyERC721Tokens map[common.Address]bool
+	tokenMetadata      *TokenMetadataResolver
+	eventDecoders      *EventDecoderRegistry
+	methodSignatures   *MethodSignatureDB
+	retraceQueue       *RetraceQueue
+	unsafeLock         sync.Mutex
+	unsafeBuilds       map[common.Hash]*unsafeBuild // 未确认区块的记录, 区块确认时直接使用
 }
 
-func NewTransactionExporter(appConfig *AppConfig, ethereum *eth.Ethereum) *TransactionExporter {
-	var saver Saver = &MongoSaver{}
-	if appConfig.Saver == "mongo" {
-		saver = &MongoSaver{
-			appConfig: appConfig,
+type unsafeBuild struct {
+	number          uint64
+	transactionList []Transaction
+}
+
+// NewTransactionExporter creates an exporter on a chain and its database, db
+// caches the token metadata, keeps the transactions to retrace and may be nil.
+func NewTransactionExporter(appConfig *AppConfig, chain *core.BlockChain, chainDb ethdb.Database, saver Saver, db ethdb.Database) *TransactionExporter {
+	eventDecoders, err := LoadEventDecoderRegistry(appConfig.AbiDir)
+	if err != nil {
+		log.Errorf("load abi dir %v error %v", appConfig.AbiDir, err)
+		eventDecoders = NewEventDecoderRegistry()
+	}
+	methodSignatures, err := LoadMethodSignatureDB(appConfig.SignatureDir)
+	if err != nil {
+		log.Errorf("load signature dir %v error %v", appConfig.SignatureDir, err)
+		methodSignatures = NewMethodSignatureDB()
+	}
+	wrappedTokens := map[common.Address]bool{}
+	for _, address := range appConfig.WrappedTokenAddressList {
+		wrappedTokens[common.HexToAddress(address)] = true
+	}
+	legacyERC721Tokens := map[common.Address]bool{}
+	for _, address := range appConfig.LegacyERC721AddressList {
+		legacyERC721Tokens[common.HexToAddress(address)] = true
+	}
+	var retraceQueue *RetraceQueue
+	if db != nil {
+		retraceQueue = NewRetraceQueue(appConfig, db)
+	}
+	return &TransactionExporter{
+		appConfig:          appConfig,
+		chainConfig:        chain.Config(),
+		chain:              chain,
+		tracer:             NewTransactionTracer(chain, chainDb, appConfig.Timeout, appConfig.Reexec),
+		saver:              saver,
+		wrappedTokens:      wrappedTokens,
+		legacyERC721Tokens: legacyERC721Tokens,
+		tokenMetadata:      NewTokenMetadataResolver(chain, db),
+		eventDecoders:      eventDecoders,
+		methodSignatures:   methodSignatures,
+		retraceQueue:       retraceQueue,
+		unsafeBuilds:       map[common.Hash]*unsafeBuild{},
+	}
+}
+
+// attachTokenMetadata fills the symbol and decimals of the token records,
+// resolved at the state after the given block.
+func (s *TransactionExporter) attachTokenMetadata(transactionList []Transaction, block *types.Block) {
+	//同一个区块里的代币只查一次
+	resolved := map[common.Address]*TokenMetadata{}
+	for i := range transactionList {
+		transaction := &transactionList[i]
+		//只查询代币记录, 事件和合约创建记录的合约不一定是代币
+		if !isTokenRecord(transaction) || transaction.ContractAddress == "" {
+			continue
 		}
-	} else if appConfig.Saver == "http" {
-		saver = &HttpSaver{
-			appConfig: appConfig,
+		address := common.HexToAddress(transaction.ContractAddress)
+		metadata, ok := resolved[address]
+		if !ok {
+			metadata = s.tokenMetadata.Resolve(address, block)
+			resolved[address] = metadata
 		}
-	} else {
-		saver = &DummySaver{
-			appConfig: appConfig,
+		if metadata == nil {
+			continue
 		}
-	}
-	tracerType := "callTracer"
-	traceConfig := &eth.TraceConfig{
-		Tracer: &tracerType,
-		LogConfig: &vm.LogConfig{
-			DisableMemory:  false,
-			DisableStack:   false,
-			DisableStorage: false,
-		},
-		Timeout: &appConfig.Timeout,
-		Reexec:  &appConfig.Reexec,
-	}
-	privateDebugAPI := eth.NewPrivateDebugAPI(ethereum)
-	return &TransactionExporter{
-		appConfig:       appConfig,
-		chainConfig:     ethereum.BlockChain().Config(),
-		ethereum:        ethereum,
-		traceConfig:     traceConfig,
-		privateDebugAPI: privateDebugAPI,
-		saver:           saver,
+		transaction.TokenSymbol = metadata.Symbol
+		transaction.TokenDecimals = metadata.Decimals
 	}
 }
 
 func (s *TransactionExporter) ExportGenesisBlocks(block *types.Block, stateDump state.Dump) (int64, error) {
+	return s.saver.SaveTransactionList(s.BuildGenesisBlock(block, stateDump))
+}
+
+// buildGenesisBlock builds the records of the genesis allocations from the
+// state of the genesis block.
+func (s *TransactionExporter) buildGenesisBlock(block *types.Block) []Transaction {
+	stateDB, err := s.chain.StateAt(block.Root())
+	if err != nil {
+		log.Errorf("Failed to get state DB for genesis Block: %v", err)
+		return nil
+	}
+	return s.BuildGenesisBlock(block, stateDB.RawDump(false, false, true))
+}
+
+func (s *TransactionExporter) BuildGenesisBlock(block *types.Block, stateDump state.Dump) []Transaction {
 	var transactionList []Transaction
+	//map的遍历顺序不固定, 按地址排序保证每次导出的序号一致
+	addressList := make([]common.Address, 0, len(stateDump.Accounts))
+	for address := range stateDump.Accounts {
+		addressList = append(addressList, address)
+	}
+	sort.Slice(addressList, func(i, j int) bool {
+		return bytes.Compare(addressList[i].Bytes(), addressList[j].Bytes()) < 0
+	})
 	i := 0
-	for address, account := range stateDump.Accounts {
+	for _, address := range addressList {
+		account := stateDump.Accounts[address]
 		balance, ok := new(big.Int).SetString(account.Balance, 10)
 		if !ok {
 			log.Errorf("could not decode balance %v of genesis account", account.Balance)
@@ -94,18 +159,32 @@ func (s *TransactionExporter) ExportGenesisBlocks(block *types.Block, stateDump
 		transaction.TokenType = TokenTypeDefault
 		transaction.Data = nil
 		transaction.Status = TransactionStatusSuccess
+		transaction.Stream = StreamConfirmed
 
 		transactionList = append(transactionList, transaction)
 		i += 1
 	}
+	return transactionList
+}
+
+func (s *TransactionExporter) SaveTransactionList(transactionList []Transaction) (int64, error) {
 	return s.saver.SaveTransactionList(transactionList)
 }
 
-//todo 完善逻辑
-func (s *TransactionExporter) ExportRemovedLogs(log1 *types.Log) (int64, error) {
-	marshal, _ := json.Marshal(log1)
-	log.Warnf("%v", string(marshal))
-	return 0, nil
+// SaveToSink saves the records to a single sink of the saver.
+func (s *TransactionExporter) SaveToSink(sink string, transactionList []Transaction) (int64, error) {
+	return SaveToSink(s.saver, sink, transactionList)
+}
+
+// ExportRemovedTransactions sends retraction records for transactions exported
+// from a block that is no longer part of the canonical chain.
+func (s *TransactionExporter) ExportRemovedTransactions(transactionList []Transaction) (int64, error) {
+	removedTransactionList := make([]Transaction, len(transactionList))
+	for i, transaction := range transactionList {
+		transaction.Removed = true
+		removedTransactionList[i] = transaction
+	}
+	return s.saver.SaveTransactionList(removedTransactionList)
 }
 
 func (s *TransactionExporter) ExportPendingTx(tx *types.Transaction) (int64, error) {
@@ -140,46 +219,117 @@ func (s *TransactionExporter) ExportPendingTx(tx *types.Transaction) (int64, err
 		GasPrice:         *tx.GasPrice(),
 		UsedGas:          *big.NewInt(int64(tx.Gas())),
 		Status:           TransactionStatusPending,
+		Stream:           StreamPending,
 	}
-	s.parseTransactionTokenInfo(&transaction, nil)
+	currentBlock := s.chain.CurrentBlock()
+	s.methodSignatures.Decode(&transaction)
+	s.parseTransactionTokenInfo(&transaction, nil, currentBlock)
+	transactionList := []Transaction{transaction}
+	s.attachTokenMetadata(transactionList, currentBlock)
 
-	return s.saver.SaveTransactionList([]Transaction{transaction})
+	return s.saver.SaveTransactionList(transactionList)
 }
 
-func (s *TransactionExporter) parseTransactionTokenInfo(transaction *Transaction, receipt *types.Receipts) *Transaction {
-	if transaction.Data == nil {
+// parseTransactionTokenInfo decodes the token call of a top level record, the
+// receipt may be nil for a pending transaction.
+func (s *TransactionExporter) parseTransactionTokenInfo(transaction *Transaction, receipt *types.Receipt, block *types.Block) *Transaction {
+	if transaction.To == "" || len(transaction.Data) < 10 {
+		return transaction
+	}
+	if _, ok := tokenMethods[string(transaction.Data[:10])]; !ok {
+		//不是代币方法, 不需要查询合约类型
 		return transaction
 	}
-	data := transaction.Data
 	// Function: transfer(address _to, uint256 _value)
 	// MethodID: 0xa9059cbb
-	// 0xa9059cbb000000000000000000000000
 	// [0]:00000000000000000000000075186ece18d7051afb9c1aee85170c0deda23d82
 	// [1]:0000000000000000000000000000000000000000000000364db9fbe6a7902000
-	if len(data) > 74 && string(data[:10]) == "0xa9059cbb" {
-		//tx.MethodId = string(data[:10])
-		transaction.ContractAddress = transaction.To
-		if receipt != nil {
-			if len(*receipt) > 0 {
-				contractAddress := (*receipt)[0].ContractAddress.String()
-				if contractAddress != transaction.ContractAddress {
-					transaction.ContractAddress = contractAddress
-					log.Warnf("transaction %v to %v not equal contract address of receipt %v", transaction.Hash, transaction.To, contractAddress)
-				}
-			}
-		}
-		transaction.To = string(append([]byte{'0', 'x'}, data[34:74]...))
-		transaction.TokenValue.UnmarshalJSON(append([]byte{'0', 'x'}, data[74:]...))
-		transaction.TokenType = TokenTypeToken
-	}
+	// 其他支持的方法见 token_call.go
+	decodeTokenCall(transaction, s.isERC721Contract(common.HexToAddress(transaction.To), receipt, block))
 	return transaction
 }
 
 func (s *TransactionExporter) ExportBlock(block *types.Block) (int64, error) {
-	if block == nil || len(block.Transactions()) == 0 {
+	if block == nil || len(block.Transactions()) == 0 && block.NumberU64() != 0 {
 		return 0, nil
 	}
+	return s.saver.SaveTransactionList(s.BuildBlock(block))
+}
+
+// BuildUnsafeBlock builds the records of a block that has not reached the
+// confirmation depth yet. They are tagged as the unsafe stream, and kept so
+// the block is not traced again when it is confirmed.
+func (s *TransactionExporter) BuildUnsafeBlock(block *types.Block) []Transaction {
+	//未确认的区块可能被回滚, 超时的交易在区块确认导出时再排队重新跟踪
+	transactionList := s.buildBlock(block)
+	s.putUnsafeBuild(block, transactionList)
+	unsafeList := make([]Transaction, len(transactionList))
+	for i, transaction := range transactionList {
+		transaction.Stream = StreamUnsafe
+		unsafeList[i] = transaction
+	}
+	return unsafeList
+}
+
+func (s *TransactionExporter) putUnsafeBuild(block *types.Block, transactionList []Transaction) {
+	if len(transactionList) == 0 {
+		return
+	}
+	s.unsafeLock.Lock()
+	defer s.unsafeLock.Unlock()
+
+	number := block.NumberU64()
+	s.unsafeBuilds[block.Hash()] = &unsafeBuild{number: number, transactionList: transactionList}
+	//回滚掉的区块不会确认, 超过两倍确认数的丢弃
+	for hash, build := range s.unsafeBuilds {
+		if build.number+2*s.appConfig.ConfirmationDepth < number {
+			delete(s.unsafeBuilds, hash)
+		}
+	}
+}
+
+func (s *TransactionExporter) takeUnsafeBuild(block *types.Block) ([]Transaction, bool) {
+	s.unsafeLock.Lock()
+	defer s.unsafeLock.Unlock()
+
+	build, ok := s.unsafeBuilds[block.Hash()]
+	if !ok {
+		return nil, false
+	}
+	delete(s.unsafeBuilds, block.Hash())
+	return build.transactionList, true
+}
+
+// BuildBlock builds the records of a block, the transactions whose trace
+// timed out are queued to be traced again, whoever exports the block. The
+// records built when the block was exported as unsafe are reused.
+func (s *TransactionExporter) BuildBlock(block *types.Block) []Transaction {
+	transactionList, ok := s.takeUnsafeBuild(block)
+	if !ok {
+		transactionList = s.buildBlock(block)
+	}
+	if s.retraceQueue != nil {
+		s.retraceQueue.Put(transactionList)
+	}
+	return transactionList
+}
+
+func (s *TransactionExporter) buildBlock(block *types.Block) []Transaction {
+	if block != nil && block.NumberU64() == 0 {
+		return s.buildGenesisBlock(block)
+	}
+	if block == nil || len(block.Transactions()) == 0 {
+		return nil
+	}
 	signer := types.MakeSigner(s.chainConfig, block.Number())
+	receipts := s.chain.GetReceiptsByHash(block.Hash())
+	if len(receipts) != len(block.Transactions()) {
+		log.Errorf("block %v has %v receipts for %v transactions", block.Number().Uint64(), len(receipts), len(block.Transactions()))
+		receipts = nil
+	}
+
+	//整个区块只执行一次, 得到每个交易的调用树
+	traces, traceErrs := s.tracer.TraceBlock(context.Background(), block)
 
 	lock := &sync.Mutex{}
 	wg := &sync.WaitGroup{}
@@ -189,7 +339,11 @@ func (s *TransactionExporter) ExportBlock(block *types.Block) (int64, error) {
 		go func(index int) {
 			defer wg.Done()
 
-			transactionList, _ := s.processTx(signer, block, index)
+			var receipt *types.Receipt
+			if receipts != nil {
+				receipt = receipts[index]
+			}
+			transactionList, _ := s.processTx(signer, block, index, receipt, traces[index], traceErrs[index])
 			if len(transactionList) > 0 {
 				func() {
 					lock.Lock()
@@ -200,10 +354,43 @@ func (s *TransactionExporter) ExportBlock(block *types.Block) (int64, error) {
 		}(index)
 	}
 	wg.Wait()
-	return s.saver.SaveTransactionList(result)
+	//交易是并发处理的, 按照交易、内部交易、日志的顺序输出
+	SortTransactionList(result)
+	s.attachTokenMetadata(result, block)
+	for i := range result {
+		result[i].Stream = StreamConfirmed
+	}
+	return result
+}
+
+// RetraceTransaction traces a transaction of a block again with another
+// timeout, and builds its records the way BuildBlock does. It fails with
+// errTraceTimeout when the trace takes too long again.
+func (s *TransactionExporter) RetraceTransaction(ctx context.Context, block *types.Block, index int, timeout time.Duration) ([]Transaction, error) {
+	receipts := s.chain.GetReceiptsByHash(block.Hash())
+	if len(receipts) != len(block.Transactions()) || index >= len(receipts) {
+		return nil, fmt.Errorf("block %v has %v receipts for %v transactions", block.Number().Uint64(), len(receipts), len(block.Transactions()))
+	}
+	trace, err := s.tracer.withTimeout(timeout).TraceTransaction(ctx, block, index)
+	if err != nil {
+		return nil, err
+	}
+	signer := types.MakeSigner(s.chainConfig, block.Number())
+	transactionList, err := s.processTx(signer, block, index, receipts[index], trace, nil)
+	if err != nil {
+		return nil, err
+	}
+	SortTransactionList(transactionList)
+	s.attachTokenMetadata(transactionList, block)
+	for i := range transactionList {
+		transactionList[i].Stream = StreamConfirmed
+	}
+	return transactionList, nil
 }
 
-func (s *TransactionExporter) processTx(signer types.Signer, block *types.Block, index int) ([]Transaction, error) {
+// processTx builds the records of a transaction from its receipt and its call
+// tree, traceErr tells why the transaction has no call tree.
+func (s *TransactionExporter) processTx(signer types.Signer, block *types.Block, index int, receipt *types.Receipt, trace *callFrame, traceErr error) ([]Transaction, error) {
 	var transactionList []Transaction
 	tx := block.Transactions()[index]
 	fromAddress, err := types.Sender(signer, tx)
@@ -237,120 +424,50 @@ func (s *TransactionExporter) processTx(signer types.Signer, block *types.Block,
 		UsedGas:          *big.NewInt(int64(tx.Gas())),
 		Status:           TransactionStatusSuccess,
 	}
-	receiptsList, err := s.ethereum.APIBackend.GetReceipts(context.Background(), tx.Hash())
-	if err != nil {
-		log.Errorf("get receipts by %v error %v", tx.Hash().String(), err)
-	}
-	if receiptsList == nil {
-		s.parseTransactionTokenInfo(&transaction, nil)
-	} else {
-		s.parseTransactionTokenInfo(&transaction, &receiptsList)
-	}
-	if len(receiptsList) > 0 {
-		marshal1, _ := json.Marshal(receiptsList)
-		log.Infof("receiptsList %v %v", tx.Hash().String(), string(marshal1))
-		for _, receipt := range receiptsList {
-			transaction.Status = receipt.Status
-
-			for _, log1 := range receipt.Logs {
-				if len(log1.Topics) <= 0 {
-					continue
-				}
-				eventFunSign := log1.Topics[0].String()
-				//keccak256("Transfer(address,address,uint256)")
-				if !(eventFunSign == "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef" &&
-					len(log1.Topics) == 3) {
-					// 跳过不是transfer转账类型
-					continue
-				}
-				transaction1 := &Transaction{
-					Timestamp: *big.NewInt(int64(block.Time())),
-					Gas:       *big.NewInt(int64(receipt.CumulativeGasUsed)),
-					GasPrice:  *tx.GasPrice(),
-					UsedGas:   *big.NewInt(int64(receipt.GasUsed)),
-					Hash:      tx.Hash().String(),
-					Nonce:     tx.Nonce(),
-					From:      fromAddress.String(),
-					To:        to,
-					Status:    receipt.Status,
-				}
-				topic1 := log1.Topics[1].Bytes()
-				transaction1.From = string(topic1[len(topic1)-40 : len(topic1)])
-				if !strings.HasPrefix(transaction1.From, "0x") {
-					transaction1.From = "0x" + transaction1.From
-				}
-				topic2 := log1.Topics[2].Bytes()
-				transaction1.To = string(topic2[len(topic2)-40 : len(topic2)])
-				if !strings.HasPrefix(transaction1.To, "0x") {
-					transaction1.To = "0x" + transaction1.To
-				}
-				transaction1.ContractAddress = log1.Address.String()
-				transaction1.TokenType = TokenTypeToken
-				transaction1.BlockHash = log1.BlockHash.String()
-				transaction1.BlockNumber = *big.NewInt(int64(log1.BlockNumber))
-				transaction1.TransactionIndex = *big.NewInt(int64(log1.TxIndex))
-				transaction1.LogIndex = *big.NewInt(int64(log1.Index))
-				transaction1.InternalIndex = InternalIndexDefault
-				transaction1.TokenValue.UnmarshalJSON(log1.Data)
-
-				transactionList = append(transactionList, *transaction1)
-			}
+	s.methodSignatures.Decode(&transaction)
+	s.parseTransactionTokenInfo(&transaction, receipt, block)
+	if receipt != nil {
+		transaction.Status = receiptStatus(receipt)
+		transactionList = append(transactionList, s.parseTokenEvents(transaction, receipt)...)
+		if toAddress == nil {
+			transaction.ContractAddress = receipt.ContractAddress.String()
 		}
 	}
 
-	var rawMessageInterface interface{}
-	func() {
-		startTime := time.Now().UnixNano()
-		defer func() {
-			elapse := (time.Now().UnixNano() - startTime) / 10e6
-			if elapse > 500 {
-				log.Infof("trace transaction %v elapse time %vms", tx.Hash().String(), elapse)
-			}
-		}()
-		rawMessageInterface, err = s.privateDebugAPI.TraceTransaction(context.Background(), tx.Hash(), s.traceConfig)
-	}()
-	if err != nil {
-		log.Errorf("trace transaction %v error %v", tx.Hash().String(), err)
+	if traceErr != nil {
+		log.Errorf("trace transaction %v error %v", tx.Hash().String(), traceErr)
 		//设置超时状态
-		if strings.Contains(err.Error(), "execution timeout") {
+		if traceErr == errTraceTimeout {
 			transaction.Status = TransactionStatusTimeout
 		}
 	} else {
-		if rawMessageInterface != nil {
-			rawMessage := rawMessageInterface.(json.RawMessage)
-			jsonParsed, err := gabs.ParseJSON(rawMessage)
-			if err != nil {
-				log.Errorf("parse json %v error %v", string(rawMessage), err)
-			} else {
-				//标记当前交易是什么op code
-				if jsonParsed.ExistsP("type") {
-					typeData := jsonParsed.Path("type").Data()
-					if typeData != nil {
-						transaction.OpCode = typeData.(string)
-					}
-				}
-				if jsonParsed.ExistsP("calls") {
-					log.Debugf("rawMessage %v %v", tx.Hash().String(), jsonParsed.String())
-					internalIndex := transaction.InternalIndex
-					children, _ := jsonParsed.S("calls").Children()
-					var internalTransactionList = list.New()
-					for i, child := range children {
-						newInternalIndex := fmt.Sprintf("%v_%v", internalIndex, i)
-						s.parseRawMessage(newInternalIndex, transaction, block, tx, child, internalTransactionList)
-					}
-					for element := internalTransactionList.Front(); element != nil; element = element.Next() {
-						transactionList = append(transactionList, element.Value.(Transaction))
-					}
-				}
+		//标记当前交易是什么op code
+		transaction.OpCode = trace.Type
+		if len(trace.Calls) > 0 {
+			internalIndex := transaction.InternalIndex
+			var internalTransactionList = list.New()
+			for i, child := range trace.Calls {
+				newInternalIndex := fmt.Sprintf("%v_%v", internalIndex, i)
+				s.parseCallFrame(newInternalIndex, transaction, block, tx, child, internalTransactionList)
+			}
+			for element := internalTransactionList.Front(); element != nil; element = element.Next() {
+				transactionList = append(transactionList, element.Value.(Transaction))
 			}
 		}
 	}
+	transactionList = append(transactionList, parseContractCreations(transaction, trace, toAddress == nil)...)
+	//调用树和receipt只挂在交易本身的记录上, flat 格式输出时去掉
+	if trace != nil {
+		transaction.CallTree = newCallTreeNode(trace, InternalIndexDefault, receipt)
+	}
+	transaction.Receipt = receipt
 	transactionList = append(transactionList, transaction)
+	linkWrappedTokenEvents(transactionList, s.wrappedTokens)
 
 	return transactionList, nil
 }
 
-func (s *TransactionExporter) parseRawMessage(internalIndex string, parentTransaction Transaction, block *types.Block, tx *types.Transaction, jsonParsed *gabs.Container, internalTransactionList *list.List) {
+func (s *TransactionExporter) parseCallFrame(internalIndex string, parentTransaction Transaction, block *types.Block, tx *types.Transaction, frame *callFrame, internalTransactionList *list.List) {
 	transaction := Transaction{
 		Timestamp:        *big.NewInt(int64(block.Time())),
 		BlockNumber:      *block.Number(),
@@ -363,52 +480,47 @@ func (s *TransactionExporter) parseRawMessage(internalIndex string, parentTransa
 		GasPrice:         *tx.GasPrice(),
 		Status:           parentTransaction.Status,
 	}
-	valueData := jsonParsed.Path("value").Data()
-	if valueData != nil {
-		transaction.Value.UnmarshalJSON([]byte(valueData.(string)))
+	if frame.Value != nil {
+		transaction.Value = *frame.Value.ToInt()
 	}
-	//丢弃value=0的合约调用
-	if transaction.Value.Uint64() > 0 {
-		fromData := jsonParsed.Path("from").Data()
-		if fromData != nil {
-			transaction.From = fromData.(string)
-		}
-		toData := jsonParsed.Path("to").Data()
-		if toData != nil {
-			transaction.To = toData.(string)
-		}
-		typeData := jsonParsed.Path("type").Data()
-		if typeData != nil {
-			transaction.OpCode = typeData.(string)
+	//外层调用失败时内层调用也被回滚
+	if frame.Error != "" {
+		transaction.Err = frame.Error
+		transaction.Status = TransactionStatusFailed
+	}
+	//上层调用没有导出时指向最近一层导出的上层调用, 子调用沿用
+	transaction.ParentInternalIndex = parentTransaction.InternalIndex
+	if transaction.ParentInternalIndex == "" {
+		transaction.ParentInternalIndex = parentTransaction.ParentInternalIndex
+	}
+	//转移了ETH的调用和自毁总是导出, 其他调用按 internalcallmode 导出
+	if transaction.Value.Sign() > 0 || frame.Type == OpCodeSelfDestruct || s.appConfig.IsInternalCallExported(frame.Type) {
+		transaction.From = frame.From
+		transaction.To = frame.To
+		transaction.OpCode = frame.Type
+		if frame.Type == OpCodeSelfDestruct {
+			transaction.ContractAddress = transaction.From
 		}
-		gasData := jsonParsed.Path("gas").Data()
-		if gasData != nil {
-			transaction.Gas.UnmarshalJSON([]byte(gasData.(string)))
+		if frame.Gas != nil {
+			transaction.Gas = *new(big.Int).SetUint64(uint64(*frame.Gas))
 		}
-		gasUsedData := jsonParsed.Path("gasUsed").Data()
-		if gasUsedData != nil {
-			transaction.UsedGas.UnmarshalJSON([]byte(gasUsedData.(string)))
+		if frame.GasUsed != nil {
+			transaction.UsedGas = *new(big.Int).SetUint64(uint64(*frame.GasUsed))
 		}
-		inputData := jsonParsed.Path("input").Data()
-		if inputData != nil {
-			transaction.Data = []byte(inputData.(string))
+		if frame.Input != nil {
+			transaction.Data = []byte(frame.Input.String())
+			s.methodSignatures.Decode(&transaction)
 		}
-
-		if jsonParsed.Exists("error") {
-			transaction.Err = jsonParsed.Path("error").Data().(string)
-			if transaction.Err != "" {
-				transaction.Status = TransactionStatusFailed
-			}
+		if frame.Output != nil {
+			transaction.Output = frame.Output.String()
 		}
 		transaction.InternalIndex = internalIndex
+		transaction.Depth = uint64(strings.Count(internalIndex, "_"))
 
 		internalTransactionList.PushBack(transaction)
 	}
-	if jsonParsed.ExistsP("calls") {
-		children, _ := jsonParsed.S("calls").Children()
-		for index, child := range children {
-			newInternalIndex := fmt.Sprintf("%v_%v", internalIndex, index)
-			s.parseRawMessage(newInternalIndex, transaction, block, tx, child, internalTransactionList)
-		}
+	for index, child := range frame.Calls {
+		newInternalIndex := fmt.Sprintf("%v_%v", internalIndex, index)
+		s.parseCallFrame(newInternalIndex, transaction, block, tx, child, internalTransactionList)
 	}
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"container/list"
 	"encoding/json"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"math/big"
 	"testing"
 )
@@ -41,3 +43,124 @@ func TestParseData(t *testing.T) {
 	data := []byte("MHhiNjFkMjdmNjAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMGUxYWY4NDBhNWExY2IxZWZkZjYwOGE5N2FhNjMyZjRhYTM5ZWQxOTkwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAxYmMxNmQ2NzRlYzgwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA2MDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAw")
 	fmt.Println(hexutil.Bytes(data).String())
 }
+
+func TestParseSelfDestruct(t *testing.T) {
+	trace := &callFrame{}
+	err := json.Unmarshal([]byte(`{
+		"type": "CALL", "from": "0x000000000000000000000000000000000000000a", "to": "0x00000000000000000000000000000000000000c1",
+		"calls": [
+			{"type": "SELFDESTRUCT", "from": "0x00000000000000000000000000000000000000c1", "to": "0x00000000000000000000000000000000000000b1", "value": "0x0"},
+			{"type": "CALL", "from": "0x00000000000000000000000000000000000000c1", "to": "0x00000000000000000000000000000000000000c2", "value": "0x0", "error": "execution reverted",
+				"calls": [
+					{"type": "SELFDESTRUCT", "from": "0x00000000000000000000000000000000000000c2", "to": "0x00000000000000000000000000000000000000b2", "value": "0x10"}
+				]}
+		]
+	}`), trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := &TransactionExporter{appConfig: &AppConfig{}, methodSignatures: NewMethodSignatureDB()}
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(100)})
+	tx := types.NewTransaction(0, common.HexToAddress("0xc1"), big.NewInt(0), 100000, big.NewInt(1), nil)
+	parent := Transaction{InternalIndex: InternalIndexDefault, Status: TransactionStatusSuccess}
+	internalTransactionList := list.New()
+	for i, child := range trace.Calls {
+		exporter.parseCallFrame(fmt.Sprintf("0_%v", i), parent, block, tx, child, internalTransactionList)
+	}
+	if internalTransactionList.Len() != 2 {
+		t.Fatalf("got %v records", internalTransactionList.Len())
+	}
+
+	//没有余额的自毁也导出
+	selfDestruct := internalTransactionList.Front().Value.(Transaction)
+	if selfDestruct.OpCode != OpCodeSelfDestruct || selfDestruct.InternalIndex != "0_0" || selfDestruct.Status != TransactionStatusSuccess ||
+		selfDestruct.ContractAddress != "0x00000000000000000000000000000000000000c1" || selfDestruct.To != "0x00000000000000000000000000000000000000b1" {
+		t.Fatalf("got %+v", selfDestruct)
+	}
+
+	//外层调用回滚, 自毁也失败
+	reverted := internalTransactionList.Back().Value.(Transaction)
+	if reverted.InternalIndex != "0_1_0" || reverted.Value.Int64() != 16 || reverted.Status != TransactionStatusFailed {
+		t.Fatalf("got %+v", reverted)
+	}
+}
+
+func TestParseCallFrameModes(t *testing.T) {
+	trace := &callFrame{}
+	err := json.Unmarshal([]byte(`{
+		"type": "CALL", "from": "0x000000000000000000000000000000000000000a", "to": "0x00000000000000000000000000000000000000c1",
+		"calls": [
+			{"type": "DELEGATECALL", "from": "0x00000000000000000000000000000000000000c1", "to": "0x00000000000000000000000000000000000000c2", "gas": "0x100", "gasUsed": "0x10", "input": "0x70a08231000000000000000000000000000000000000000000000000000000000000000a", "output": "0x01",
+				"calls": [
+					{"type": "CALL", "from": "0x00000000000000000000000000000000000000c1", "to": "0x00000000000000000000000000000000000000b1", "value": "0x5", "input": "0x"}
+				]},
+			{"type": "STATICCALL", "from": "0x00000000000000000000000000000000000000c1", "to": "0x00000000000000000000000000000000000000c3", "input": "0x", "error": "out of gas"}
+		]
+	}`), trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(100)})
+	tx := types.NewTransaction(0, common.HexToAddress("0xc1"), big.NewInt(0), 100000, big.NewInt(1), nil)
+	parent := Transaction{InternalIndex: InternalIndexDefault, Status: TransactionStatusSuccess}
+	parse := func(appConfig *AppConfig) []Transaction {
+		exporter := &TransactionExporter{appConfig: appConfig, methodSignatures: NewMethodSignatureDB()}
+		internalTransactionList := list.New()
+		for i, child := range trace.Calls {
+			exporter.parseCallFrame(fmt.Sprintf("0_%v", i), parent, block, tx, child, internalTransactionList)
+		}
+		var transactionList []Transaction
+		for element := internalTransactionList.Front(); element != nil; element = element.Next() {
+			transactionList = append(transactionList, element.Value.(Transaction))
+		}
+		return transactionList
+	}
+
+	//默认只导出转移了ETH的调用
+	transactionList := parse(&AppConfig{})
+	if len(transactionList) != 1 || transactionList[0].InternalIndex != "0_0_0" || transactionList[0].Depth != 2 || transactionList[0].ParentInternalIndex != InternalIndexDefault {
+		t.Fatalf("got %+v", transactionList)
+	}
+
+	transactionList = parse(&AppConfig{InternalCallMode: InternalCallModeAll})
+	if len(transactionList) != 3 {
+		t.Fatalf("got %v records", len(transactionList))
+	}
+	delegateCall := transactionList[0]
+	if delegateCall.OpCode != "DELEGATECALL" || delegateCall.Depth != 1 || delegateCall.ParentInternalIndex != InternalIndexDefault ||
+		delegateCall.Output != "0x01" || delegateCall.Gas.Int64() != 0x100 || delegateCall.UsedGas.Int64() != 0x10 || delegateCall.MethodName != "balanceOf" {
+		t.Fatalf("got %+v", delegateCall)
+	}
+	//上层调用导出时指向上层调用
+	if transactionList[1].ParentInternalIndex != "0_0" {
+		t.Fatalf("got %+v", transactionList[1])
+	}
+	if staticCall := transactionList[2]; staticCall.Err != "out of gas" || staticCall.Status != TransactionStatusFailed {
+		t.Fatalf("got %+v", staticCall)
+	}
+
+	transactionList = parse(&AppConfig{InternalCallMode: InternalCallModeTypes, InternalCallTypeList: []string{"staticcall"}})
+	if len(transactionList) != 2 || transactionList[1].OpCode != "STATICCALL" {
+		t.Fatalf("got %+v", transactionList)
+	}
+}
+
+func TestUnsafeBuild(t *testing.T) {
+	exporter := &TransactionExporter{appConfig: &AppConfig{ConfirmationDepth: 2}, unsafeBuilds: map[common.Hash]*unsafeBuild{}}
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(100)})
+	exporter.putUnsafeBuild(block, []Transaction{{Hash: "0x01", Stream: StreamConfirmed}})
+	//确认时直接使用, 只用一次
+	if transactionList, ok := exporter.takeUnsafeBuild(block); !ok || len(transactionList) != 1 || transactionList[0].Stream != StreamConfirmed {
+		t.Fatalf("got %v %v", transactionList, ok)
+	}
+	if _, ok := exporter.takeUnsafeBuild(block); ok {
+		t.Fatalf("unsafe build taken twice")
+	}
+
+	//回滚掉的区块超过两倍确认数后丢弃
+	exporter.putUnsafeBuild(block, []Transaction{{Hash: "0x01"}})
+	exporter.putUnsafeBuild(types.NewBlockWithHeader(&types.Header{Number: big.NewInt(105)}), []Transaction{{Hash: "0x02"}})
+	if _, ok := exporter.takeUnsafeBuild(block); ok || len(exporter.unsafeBuilds) != 1 {
+		t.Fatalf("got %v unsafe builds", len(exporter.unsafeBuilds))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestSortTransactionList(t *testing.T) {
+	newTransaction := func(transactionIndex int64, internalIndex string, logIndex int64) Transaction {
+		return Transaction{
+			TransactionIndex: *big.NewInt(transactionIndex),
+			InternalIndex:    internalIndex,
+			LogIndex:         *big.NewInt(logIndex),
+		}
+	}
+	transactionList := []Transaction{
+		newTransaction(1, "0", -1),
+		newTransaction(0, "0_10", -1),
+		newTransaction(0, "0_2_0", -1),
+		newTransaction(0, "0", 3),
+		newTransaction(0, "0_2", -1),
+		newTransaction(0, "0", -1),
+		newTransaction(0, "0", 1),
+	}
+	SortTransactionList(transactionList)
+
+	want := []Transaction{
+		newTransaction(0, "0", -1),
+		newTransaction(0, "0", 1),
+		newTransaction(0, "0", 3),
+		newTransaction(0, "0_2", -1),
+		newTransaction(0, "0_2_0", -1),
+		newTransaction(0, "0_10", -1),
+		newTransaction(1, "0", -1),
+	}
+	for i := range want {
+		got := transactionList[i]
+		if got.TransactionIndex.Cmp(&want[i].TransactionIndex) != 0 || got.InternalIndex != want[i].InternalIndex || got.LogIndex.Cmp(&want[i].LogIndex) != 0 {
+			t.Fatalf("position %v got %v/%v/%v", i, got.TransactionIndex.String(), got.InternalIndex, got.LogIndex.String())
+		}
+	}
+}
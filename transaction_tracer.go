@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// 和 debug_traceTransaction 的默认值一致
+const defaultTraceTimeout = 5 * time.Second
+
+// TransactionTracer re-executes transactions with the native CallTracer, the
+// same way debug_traceTransaction does with a JavaScript tracer.
+type TransactionTracer struct {
+	chain   *core.BlockChain
+	chainDb ethdb.Database
+	timeout time.Duration
+	reexec  uint64
+}
+
+// NewTransactionTracer creates a tracer, timeout is a duration like 5s and
+// bounds the trace of one transaction, reexec is the number of blocks that may
+// be re-executed to rebuild a missing state.
+func NewTransactionTracer(chain *core.BlockChain, chainDb ethdb.Database, timeout string, reexec uint64) *TransactionTracer {
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		log.Warnf("invalid trace timeout %v, use %v", timeout, defaultTraceTimeout)
+		duration = defaultTraceTimeout
+	}
+	return &TransactionTracer{
+		chain:   chain,
+		chainDb: chainDb,
+		timeout: duration,
+		reexec:  reexec,
+	}
+}
+
+// stateAt returns the state after a block, re-executing up to reexec blocks
+// from the nearest available state if it was pruned.
+func (s *TransactionTracer) stateAt(block *types.Block) (*state.StateDB, error) {
+	chain := s.chain
+	statedb, err := chain.StateAt(block.Root())
+	if err == nil {
+		return statedb, nil
+	}
+	origin := block.NumberU64()
+	database := state.NewDatabaseWithCache(s.chainDb, 16)
+	for i := uint64(0); i < s.reexec; i++ {
+		block = chain.GetBlock(block.ParentHash(), block.NumberU64()-1)
+		if block == nil {
+			break
+		}
+		if statedb, err = state.New(block.Root(), database, nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*trie.MissingNodeError); ok {
+			return nil, fmt.Errorf("required historical state unavailable (reexec=%d)", s.reexec)
+		}
+		return nil, err
+	}
+	var proot common.Hash
+	for block.NumberU64() < origin {
+		number := block.NumberU64() + 1
+		if block = chain.GetBlockByNumber(number); block == nil {
+			return nil, fmt.Errorf("block #%d not found", number)
+		}
+		if _, _, _, err := chain.Processor().Process(block, statedb, vm.Config{}); err != nil {
+			return nil, fmt.Errorf("processing block %d failed: %v", block.NumberU64(), err)
+		}
+		root, err := statedb.Commit(chain.Config().IsEIP158(block.Number()))
+		if err != nil {
+			return nil, err
+		}
+		if err := statedb.Reset(root); err != nil {
+			return nil, fmt.Errorf("state reset after block %d failed: %v", block.NumberU64(), err)
+		}
+		database.TrieDB().Reference(root, common.Hash{})
+		if proot != (common.Hash{}) {
+			database.TrieDB().Dereference(proot)
+		}
+		proot = root
+	}
+	return statedb, nil
+}
+
+// TraceTransaction returns the call tree of the index-th transaction of a
+// block. It fails with errTraceTimeout when the trace takes too long.
+func (s *TransactionTracer) TraceTransaction(ctx context.Context, block *types.Block, index int) (*callFrame, error) {
+	chain := s.chain
+	parent := chain.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, fmt.Errorf("parent %#x not found", block.ParentHash())
+	}
+	statedb, err := s.stateAt(parent)
+	if err != nil {
+		return nil, err
+	}
+	signer := types.MakeSigner(chain.Config(), block.Number())
+	for i, tx := range block.Transactions() {
+		msg, _ := tx.AsMessage(signer)
+		vmctx := core.NewEVMContext(msg, block.Header(), chain, nil)
+		if i == index {
+			return s.traceMessage(ctx, msg, vmctx, statedb)
+		}
+		//执行之前的交易得到当前交易的状态
+		vmenv := vm.NewEVM(vmctx, statedb, chain.Config(), vm.Config{})
+		if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(tx.Gas())); err != nil {
+			return nil, fmt.Errorf("transaction %#x failed: %v", tx.Hash(), err)
+		}
+		statedb.Finalise(vmenv.ChainConfig().IsEIP158(block.Number()))
+	}
+	return nil, fmt.Errorf("transaction index %d out of range for block %#x", index, block.Hash())
+}
+
+// withTimeout returns a tracer of the same chain with another timeout.
+func (s *TransactionTracer) withTimeout(timeout time.Duration) *TransactionTracer {
+	tracer := *s
+	tracer.timeout = timeout
+	return &tracer
+}
+
+// stopOnTimeout stops the tracer when the trace of one transaction takes too
+// long or ctx is done, the returned function must be called when the trace is
+// done.
+func (s *TransactionTracer) stopOnTimeout(ctx context.Context, tracer *CallTracer) context.CancelFunc {
+	if ctx.Err() != nil {
+		//已经停止时不用等协程调度
+		tracer.Stop(ctx.Err())
+		return func() {}
+	} else if s.timeout <= 0 {
+		tracer.Stop(errTraceTimeout)
+		return func() {}
+	}
+	deadlineCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	go func() {
+		<-deadlineCtx.Done()
+		if deadlineCtx.Err() == context.DeadlineExceeded {
+			tracer.Stop(errTraceTimeout)
+		} else if ctx.Err() != nil {
+			tracer.Stop(ctx.Err())
+		}
+	}()
+	return cancel
+}
+
+func (s *TransactionTracer) traceMessage(ctx context.Context, msg core.Message, vmctx vm.Context, statedb *state.StateDB) (*callFrame, error) {
+	tracer := NewCallTracer()
+	cancel := s.stopOnTimeout(ctx, tracer)
+	defer cancel()
+	vmenv := vm.NewEVM(vmctx, statedb, s.chain.Config(), vm.Config{Debug: true, Tracer: tracer})
+	if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas())); err != nil {
+		return nil, fmt.Errorf("tracing failed: %v", err)
+	}
+	return tracer.GetResult()
+}
+
+// TraceBlock traces every transaction of a block in a single execution on top
+// of the parent state, instead of re-executing the earlier transactions for
+// each one. traces[i] is nil when errs[i] tells why the i-th transaction was
+// not traced, a timeout only affects its own transaction.
+func (s *TransactionTracer) TraceBlock(ctx context.Context, block *types.Block) (traces []*callFrame, errs []error) {
+	chain := s.chain
+	transactions := block.Transactions()
+	traces = make([]*callFrame, len(transactions))
+	errs = make([]error, len(transactions))
+	var statedb *state.StateDB
+	err := fmt.Errorf("parent %#x not found", block.ParentHash())
+	if parent := chain.GetBlock(block.ParentHash(), block.NumberU64()-1); parent != nil {
+		statedb, err = s.stateAt(parent)
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	s.traceTransactions(ctx, chain, chain.Config(), block, statedb, traces, errs)
+	return
+}
+
+// traceTransactions executes the transactions of a block one after another on
+// the state, filling their traces or errors.
+func (s *TransactionTracer) traceTransactions(ctx context.Context, chain core.ChainContext, config *params.ChainConfig, block *types.Block, statedb *state.StateDB, traces []*callFrame, errs []error) {
+	transactions := block.Transactions()
+	fail := func(from int, err error) {
+		for i := from; i < len(transactions); i++ {
+			errs[i] = err
+		}
+	}
+	signer := types.MakeSigner(config, block.Number())
+	for i, tx := range transactions {
+		msg, err := tx.AsMessage(signer)
+		if err != nil {
+			fail(i, fmt.Errorf("transaction %#x sender: %v", tx.Hash(), err))
+			return
+		}
+		vmctx := core.NewEVMContext(msg, block.Header(), chain, nil)
+		statedb.Prepare(tx.Hash(), block.Hash(), i)
+		snapshot := statedb.Snapshot()
+
+		startTime := time.Now()
+		tracer := NewCallTracer()
+		cancel := s.stopOnTimeout(ctx, tracer)
+		vmenv := vm.NewEVM(vmctx, statedb, config, vm.Config{Debug: true, Tracer: tracer})
+		_, err = core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+		cancel()
+		if err != nil {
+			fail(i, fmt.Errorf("transaction %#x failed: %v", tx.Hash(), err))
+			return
+		}
+		if elapse := time.Since(startTime); elapse > 500*time.Millisecond {
+			log.Infof("trace transaction %v elapse time %vms", tx.Hash().String(), elapse.Milliseconds())
+		}
+		traces[i], errs[i] = tracer.GetResult()
+		if errs[i] != nil {
+			//被中断的交易只执行了一部分, 不跟踪重新执行得到正确的状态
+			statedb.RevertToSnapshot(snapshot)
+			vmenv = vm.NewEVM(vmctx, statedb, config, vm.Config{})
+			if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas())); err != nil {
+				fail(i+1, fmt.Errorf("transaction %#x failed: %v", tx.Hash(), err))
+				return
+			}
+		}
+		statedb.Finalise(config.IsEIP158(block.Number()))
+	}
+}
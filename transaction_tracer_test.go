@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+type testChainContext struct{}
+
+func (testChainContext) Engine() consensus.Engine {
+	return ethash.NewFaker()
+}
+
+func (testChainContext) GetHeader(common.Hash, uint64) *types.Header {
+	return nil
+}
+
+func TestTraceTransactions(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	looper := common.HexToAddress("0x1f")
+	signer := types.NewEIP155Signer(params.MainnetChainConfig.ChainID)
+	var txs []*types.Transaction
+	for i, to := range []common.Address{tracerCaller, looper, tracerDestructor} {
+		tx, err := types.SignTx(types.NewTransaction(uint64(i), to, big.NewInt(1), 3000000, big.NewInt(1), nil), signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	block := types.NewBlock(&types.Header{
+		Number:     big.NewInt(10000000),
+		Time:       1600000000,
+		Difficulty: big.NewInt(1),
+		GasLimit:   10000000,
+	}, txs, nil, nil)
+
+	for _, timeout := range []time.Duration{5 * time.Second, -1} {
+		statedb := newTracerState(t)
+		statedb.SetBalance(sender, big.NewInt(params.Ether))
+		//死循环, 直到gas用完
+		statedb.SetCode(looper, asm(vm.JUMPDEST, 0, vm.JUMP))
+
+		tracer := &TransactionTracer{timeout: timeout}
+		traces := make([]*callFrame, len(txs))
+		errs := make([]error, len(txs))
+		tracer.traceTransactions(context.Background(), testChainContext{}, params.MainnetChainConfig, block, statedb, traces, errs)
+
+		if timeout > 0 {
+			for i := range txs {
+				if errs[i] != nil {
+					t.Fatalf("transaction %v: %v", i, errs[i])
+				}
+			}
+			if len(traces[0].Calls) != 12 || traces[1].Error == "" {
+				t.Fatalf("got %+v %+v", traces[0], traces[1])
+			}
+		} else if errs[1] != errTraceTimeout {
+			t.Fatalf("got %v", errs[1])
+		}
+		//超时的交易重新执行, 之后的交易看到的状态不变: 合约在第一笔交易中已经自毁, 第三笔转入的 1 留在原地址
+		if statedb.GetNonce(sender) != 3 || statedb.GetBalance(tracerBeneficiary).Int64() != 7 || statedb.GetBalance(tracerDestructor).Int64() != 1 {
+			t.Fatalf("timeout %v: nonce %v, beneficiary %v", timeout, statedb.GetNonce(sender), statedb.GetBalance(tracerBeneficiary))
+		}
+	}
+}
+
+func TestTraceTransactionsCanceled(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	looper := common.HexToAddress("0x1f")
+	signer := types.NewEIP155Signer(params.MainnetChainConfig.ChainID)
+	tx, err := types.SignTx(types.NewTransaction(0, looper, big.NewInt(1), 3000000, big.NewInt(1), nil), signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(10000000), Time: 1600000000, Difficulty: big.NewInt(1), GasLimit: 10000000}, []*types.Transaction{tx}, nil, nil)
+	statedb := newTracerState(t)
+	statedb.SetBalance(sender, big.NewInt(params.Ether))
+	statedb.SetCode(looper, asm(vm.JUMPDEST, 0, vm.JUMP))
+
+	//服务停止时正在跟踪的交易被中断
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracer := &TransactionTracer{timeout: time.Minute}
+	traces := make([]*callFrame, 1)
+	errs := make([]error, 1)
+	tracer.traceTransactions(ctx, testChainContext{}, params.MainnetChainConfig, block, statedb, traces, errs)
+	if errs[0] != context.Canceled || statedb.GetNonce(sender) != 1 {
+		t.Fatalf("got %v, nonce %v", errs[0], statedb.GetNonce(sender))
+	}
+}